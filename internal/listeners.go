@@ -0,0 +1,104 @@
+package tools
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// First file descriptor passed by systemd, see sd_listen_fds(3).
+const listenFdsStart = 3
+
+// SystemdListeners returns the sockets handed over by systemd socket activation.
+// It returns nil if the process was not started with LISTEN_PID/LISTEN_FDS.
+func SystemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+
+	// Don't pass the sockets on to lxc-attach and friends.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-fd-%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use socket fd %d: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	return listeners, nil
+}
+
+// ListenUnix listens on a unix socket at path, replacing a stale socket file
+// left behind by a previous run.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("Refusing to replace %s, it is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("Unix socket %s is already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %s: %v", path, err)
+	}
+
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("Unable to set permissions on %s: %v", path, err)
+	}
+
+	return listener, nil
+}
+
+// ListenAddresses returns the addresses clients can reach a listener on.
+// Wildcard addresses are expanded to the addresses of the local interfaces.
+func ListenAddresses(addr net.Addr) []string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	port := strconv.Itoa(tcpAddr.Port)
+	if !tcpAddr.IP.IsUnspecified() {
+		return []string{net.JoinHostPort(tcpAddr.IP.String(), port)}
+	}
+
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return []string{net.JoinHostPort(tcpAddr.IP.String(), port)}
+	}
+
+	// 0.0.0.0 only covers IPv4, [::] is dual-stack
+	onlyV4 := tcpAddr.IP.To4() != nil
+	var addresses []string
+	for _, ifaceAddr := range ifaceAddrs {
+		ipNet, ok := ifaceAddr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if onlyV4 && ipNet.IP.To4() == nil {
+			continue
+		}
+		addresses = append(addresses, net.JoinHostPort(ipNet.IP.String(), port))
+	}
+	return addresses
+}
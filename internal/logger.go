@@ -0,0 +1,40 @@
+package tools
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// NewLogger creates a slog logger. level is one of debug, info, warn or error
+// and format is either text or json.
+func NewLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if level != "" {
+		if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("Bad log level %q: %v", level, err)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("Bad log format %q, expected text or json", format)
+}
+
+// OpenLogFile opens a log file for appending, "" and "-" mean stderr.
+func OpenLogFile(path string) (io.Writer, error) {
+	if path == "" || path == "-" {
+		return os.Stderr, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open log file %s: %v", path, err)
+	}
+	return file, nil
+}
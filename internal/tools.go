@@ -9,6 +9,7 @@ import (
 	"crypto/x509/pkix"
 	"fmt"
 	"math/big"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -32,6 +33,18 @@ func SpaHandler(uiDir string) http.HandlerFunc {
 	}
 }
 
+// RedirectHandler sends plain HTTP requests to the same host on the HTTPS port.
+func RedirectHandler(httpsPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		target := "https://" + net.JoinHostPort(host, httpsPort) + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	}
+}
+
 func GenerateSelfSignedCert() (tls.Certificate, error) {
 	configFile, err := os.Open("config.yaml")
 	if err != nil {
@@ -0,0 +1,224 @@
+package lxcapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Client    string    `json:"client"`
+	Protocol  string    `json:"protocol"`
+	Address   string    `json:"address"`
+	Action    string    `json:"action"`
+	Target    string    `json:"target"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type auditLog struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	maxSize    int64
+	maxBackups int
+}
+
+var audit *auditLog
+
+// SetupAudit opens the audit log. Once it grows beyond maxSize bytes it is
+// rotated to path.1, path.2 and so on, keeping at most maxBackups old files.
+func SetupAudit(path string, maxSize int64, maxBackups int) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to open audit log %s: %v", path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Unable to stat audit log %s: %v", path, err)
+	}
+
+	audit = &auditLog{
+		path:       path,
+		file:       file,
+		size:       info.Size(),
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	return nil
+}
+
+// Audit records a change made by the client of r. err is the result of the change.
+func Audit(r *http.Request, action, target string, err error) {
+	newAuditRecord(r, action, target).finish(err)
+}
+
+// newAuditRecord starts a record for a change that finishes later, like an
+// operation running in the background.
+func newAuditRecord(r *http.Request, action, target string) AuditRecord {
+	client, protocol := ClientIdentity(r)
+	return AuditRecord{
+		Timestamp: time.Now().UTC(),
+		Client:    client,
+		Protocol:  protocol,
+		Address:   r.RemoteAddr,
+		Action:    action,
+		Target:    target,
+	}
+}
+
+// finish writes the record with the result of the change.
+func (record AuditRecord) finish(err error) {
+	record.Result = "success"
+	if err != nil {
+		record.Result = "failure"
+		record.Error = err.Error()
+	}
+	writeAudit(record)
+}
+
+// auditError turns the error string of a response into the result of an audit record.
+func auditError(responseError string, err error) error {
+	if err != nil {
+		return err
+	} else if responseError != "" {
+		return fmt.Errorf("%s", responseError)
+	}
+	return nil
+}
+
+func writeAudit(record AuditRecord) {
+	if audit == nil {
+		return
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Unable to marshal audit record", "err", err)
+		return
+	}
+	line = append(line, '\n')
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	if audit.maxSize > 0 && audit.size+int64(len(line)) > audit.maxSize {
+		if err := audit.rotate(); err != nil {
+			slog.Error("Unable to rotate audit log", "err", err)
+		}
+	}
+
+	n, err := audit.file.Write(line)
+	audit.size += int64(n)
+	if err != nil {
+		slog.Error("Unable to write audit log", "err", err)
+	}
+}
+
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	for i := a.maxBackups - 1; i > 0; i-- {
+		os.Rename(a.backupPath(i), a.backupPath(i+1))
+	}
+	if a.maxBackups > 0 {
+		os.Rename(a.path, a.backupPath(1))
+	} else {
+		os.Remove(a.path)
+	}
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	a.file = file
+	a.size = 0
+	return nil
+}
+
+func (a *auditLog) backupPath(n int) string {
+	return fmt.Sprintf("%s.%d", a.path, n)
+}
+
+// readAudit returns the records of the rotated and current audit files, oldest first.
+func readAudit() ([]AuditRecord, error) {
+	records := []AuditRecord{}
+	if audit == nil {
+		return records, nil
+	}
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	paths := []string{}
+	for i := audit.maxBackups; i > 0; i-- {
+		paths = append(paths, audit.backupPath(i))
+	}
+	paths = append(paths, audit.path)
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			records = append(records, record)
+		}
+		file.Close()
+	}
+
+	return records, nil
+}
+
+// AuditHandler serves the audit log read-only on /1.0/admin/audit.
+// The optional limit parameter only returns the newest records.
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !IsTrusted(r) {
+		forbidden(w)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	records, err := readAudit()
+	if err != nil {
+		smartError(w, fmt.Errorf("Error reading audit log: %v", err))
+		return
+	}
+
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit >= 0 && limit < len(records) {
+		records = records[len(records)-limit:]
+	}
+
+	response := GeneralResponse{
+		Type:       "sync",
+		Status:     "Success",
+		StatusCode: 200,
+		Operation:  "",
+		ErrorCode:  0,
+		Error:      "",
+		Metadata:   records,
+	}
+	json.NewEncoder(w).Encode(response)
+}
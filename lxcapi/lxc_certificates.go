@@ -2,6 +2,7 @@ package lxcapi
 
 import (
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -9,8 +10,6 @@ import (
 	"net/http"
 )
 
-var IsTrustedToken bool
-var ClientToken string
 var config Config
 
 type TokenPayload struct {
@@ -37,13 +36,9 @@ func CertificatesHandler(w http.ResponseWriter, r *http.Request) {
 	json.Unmarshal(body, &payload)
 	defer r.Body.Close()
 
-	fmt.Println("Request Method:", r.Method, "|", "Request API:", r.URL.Path)
-
 	var response map[string]any
 
-	if len(r.TLS.PeerCertificates) > 0 {
-		clientCert := r.TLS.PeerCertificates[0]
-
+	if clientCert := peerCertificate(r); clientCert != nil {
 		certPEM := pem.EncodeToMemory(&pem.Block{
 			Type:  "CERTIFICATE",
 			Bytes: clientCert.Raw,
@@ -69,7 +64,19 @@ func CertificatesHandler(w http.ResponseWriter, r *http.Request) {
 				},
 			},
 		}
+	} else if isTrustedUnixPeer(r) {
+		// Local peers are trusted by their credentials, they have no certificate
+		response = map[string]any{
+			"type":        "sync",
+			"status":      "Success",
+			"status_code": 200,
+			"operation":   "",
+			"error_code":  0,
+			"error":       "",
+			"metadata":    []map[string]any{},
+		}
 	} else if r.Method == http.MethodPost && payload.Type == "client" {
+		var accepted string
 		config := ReadClientConfig("config.yaml")
 		for _, clientToken := range config.Client.Tokens {
 			if payload.Password == clientToken.Token {
@@ -77,17 +84,16 @@ func CertificatesHandler(w http.ResponseWriter, r *http.Request) {
 				if session == "" {
 					break
 				}
-				_, err := r.Cookie("client_id")
-				if err != nil {
-					http.SetCookie(w, &http.Cookie{
-						Name:     "client_id",
-						Value:    session,
-						Expires:  expires,
-						Secure:   true,
-						HttpOnly: true,
-						SameSite: http.SameSiteLaxMode,
-					})
-				}
+				// The client is known by this cookie from now on
+				http.SetCookie(w, &http.Cookie{
+					Name:     "client_id",
+					Value:    session,
+					Expires:  expires,
+					Secure:   true,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				addTokenSession(session, clientToken.Token)
 				// Token is just a token and does not verify fingerprint,
 				// expires_at, and other information.
 				// Under normal circumstances, token should be converted to
@@ -99,28 +105,58 @@ func CertificatesHandler(w http.ResponseWriter, r *http.Request) {
 					"status":      "Success",
 					"status_code": 200,
 				}
-				IsTrustedToken = true
-				ClientToken = clientToken.Token
+				accepted = clientToken.Token
 			}
 		}
-	} else {
-		response = map[string]any{
-			"type":        "error",
-			"status":      "error",
-			"status_code": 403,
-			"error_code":  403,
-			"error":       "not authorized",
+		if accepted != "" {
+			// The request itself has no cookie yet, its client is the token
+			requestor := &EventRequestor{Username: tokenClientName(accepted), Protocol: "token", Address: r.RemoteAddr}
+			record := newAuditRecord(r, lifecycleCertificateCreated, "/1.0/certificates")
+			record.Client, record.Protocol = requestor.Username, requestor.Protocol
+			record.finish(nil)
+			SendLifecycleEvent(lifecycleCertificateCreated, "/1.0/certificates/"+requestor.Username, requestor, nil)
+		} else {
+			Audit(r, lifecycleCertificateCreated, "/1.0/certificates", fmt.Errorf("invalid token"))
 		}
 	}
 
+	if response == nil {
+		forbidden(w)
+		return
+	}
 	json.NewEncoder(w).Encode(response)
 }
 
 func IsTrusted(r *http.Request) bool {
-	if len(r.TLS.PeerCertificates) > 0 {
+	if peerCertificate(r) != nil {
 		return true
-	} else if IsTrustedToken {
+	} else if isTrustedUnixPeer(r) {
+		return true
+	} else if requestToken(r) != "" {
 		return true
 	}
 	return false
 }
+
+// ClientIdentity returns who made the request and how they authenticated: the
+// certificate fingerprint for TLS, the uid for the unix socket or the client
+// name of the token the request's session came with. Untrusted clients have
+// an empty identity.
+func ClientIdentity(r *http.Request) (string, string) {
+	if clientCert := peerCertificate(r); clientCert != nil {
+		return fmt.Sprintf("%x", sha256.Sum256(clientCert.Raw)), "tls"
+	} else if ucred, ok := unixPeer(r); ok && isTrustedUnixPeer(r) {
+		return fmt.Sprint(ucred.Uid), "unix"
+	} else if token := requestToken(r); token != "" {
+		return tokenClientName(token), "token"
+	}
+	return "", ""
+}
+
+// peerCertificate returns the client certificate, or nil for plain connections.
+func peerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
@@ -4,32 +4,109 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 var AccessTokens = make(map[string]*Base64Token)
 
 type Base64Token struct {
-	Secret    string    `json:"secret"`
-	ExpiresAt time.Time `json:"expires_at"`
+	ClientName string    `json:"client_name"`
+	Secret     string    `json:"secret"`
+	ExpiresAt  time.Time `json:"expires_at"`
 }
 
-func Base64Token2Json(token string) (string, time.Time) {
-	decoded, err := base64.StdEncoding.DecodeString(token)
+// Sessions of the clients that logged in with a token, by the secret in their
+// client_id cookie, with the token they logged in with.
+var tokenSessions = make(map[string]string)
+var muTokenSessions sync.Mutex
+
+// addTokenSession remembers that the client with the session cookie logged in with token.
+func addTokenSession(session, token string) {
+	muTokenSessions.Lock()
+	defer muTokenSessions.Unlock()
+
+	tokenSessions[session] = token
+}
+
+// requestToken returns the token the client of r logged in with, or "" if it
+// has no session, or the token expired or was removed from config.yaml.
+func requestToken(r *http.Request) string {
+	cookie, err := r.Cookie("client_id")
 	if err != nil {
-		fmt.Println("Not a base64 token:", err)
-		return "", time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC)
+		return ""
 	}
-	var tokenJson Base64Token
-	err = json.Unmarshal([]byte(decoded), &tokenJson)
+
+	muTokenSessions.Lock()
+	token, exists := tokenSessions[cookie.Value]
+	muTokenSessions.Unlock()
+	if !exists {
+		return ""
+	}
+
+	_, expires := Base64Token2Json(token)
+	if (!expires.IsZero() && expires.Before(time.Now())) || !tokenConfigured(token) {
+		muTokenSessions.Lock()
+		delete(tokenSessions, cookie.Value)
+		muTokenSessions.Unlock()
+		return ""
+	}
+	return token
+}
+
+// tokenConfigured tells whether token is still in config.yaml, so removing a
+// token logs out the clients that logged in with it. An unreadable config
+// trusts no token.
+func tokenConfigured(token string) bool {
+	configFile, err := os.Open("config.yaml")
+	if err != nil {
+		return false
+	}
+	defer configFile.Close()
+
+	var current Config
+	if err := yaml.NewDecoder(configFile).Decode(&current); err != nil {
+		return false
+	}
+	return slices.ContainsFunc(current.Client.Tokens, func(configured Token) bool { return configured.Token == token })
+}
+
+func Base64Token2Json(token string) (string, time.Time) {
+	tokenJson, err := decodeBase64Token(token)
 	if err != nil {
-		log.Fatalf("Error unmarshalling JSON: %v", err)
+		slog.Warn("Bad client token", "err", err)
 		return "", time.Date(1, time.January, 1, 0, 0, 0, 0, time.UTC)
 	}
 	return tokenJson.Secret, tokenJson.ExpiresAt
 }
 
+// tokenClientName returns the client_name stored in a token, used as its identity.
+func tokenClientName(token string) string {
+	tokenJson, err := decodeBase64Token(token)
+	if err != nil || tokenJson.ClientName == "" {
+		return "token"
+	}
+	return tokenJson.ClientName
+}
+
+func decodeBase64Token(token string) (*Base64Token, error) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("not a base64 token: %v", err)
+	}
+	var tokenJson Base64Token
+	if err := json.Unmarshal(decoded, &tokenJson); err != nil {
+		return nil, fmt.Errorf("not a JSON token: %v", err)
+	}
+	return &tokenJson, nil
+}
+
 func SaveToken(session string) error {
 	mu.Lock()
 	defer mu.Unlock()
@@ -0,0 +1,233 @@
+package lxcapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Whether lxc-checkpoint can use CRIU on this host, set by DetectCRIU.
+var criuSupported bool
+var criuUnsupportedReason = "CRIU support was not checked"
+
+// The saved state of statefully stopped instances is kept below checkpointsDir.
+var checkpointsDir = "/var/lib/lxc-ui-api/checkpoints"
+
+// SetCheckpointsDir sets the directory saved instance states are kept in.
+func SetCheckpointsDir(dir string) {
+	checkpointsDir = dir
+}
+
+// DetectCRIU checks whether instances can be checkpointed and restored.
+func DetectCRIU() {
+	if _, err := exec.LookPath("lxc-checkpoint"); err != nil {
+		criuSupported, criuUnsupportedReason = false, "lxc-checkpoint is not installed"
+	} else if _, err := exec.LookPath("criu"); err != nil {
+		criuSupported, criuUnsupportedReason = false, "criu is not installed"
+	} else {
+		cmd := exec.Command("criu", "check")
+		var out bytes.Buffer
+		cmd.Stdout = &out
+		cmd.Stderr = &out
+		if err := cmd.Run(); err != nil {
+			reason := "criu check failed"
+			if lines := lastLines(out.String(), 1); len(lines) > 0 {
+				reason += ": " + lines[0]
+			}
+			criuSupported, criuUnsupportedReason = false, reason
+		} else {
+			criuSupported, criuUnsupportedReason = true, ""
+		}
+	}
+
+	if criuSupported {
+		slog.Info("Stateful instances are supported")
+	} else {
+		slog.Info("Stateful instances are not supported", "reason", criuUnsupportedReason)
+	}
+}
+
+// checkCRIU returns why stateful operations can't be done, or nil if they can.
+func checkCRIU() error {
+	if !criuSupported {
+		return badRequestError("Stateful operations need CRIU, which isn't usable on this host: %s", criuUnsupportedReason)
+	}
+	return nil
+}
+
+// instanceStateDir returns where the state of a statefully stopped instance is saved.
+func instanceStateDir(instanceName string) string {
+	return filepath.Join(checkpointsDir, instanceName, "state")
+}
+
+// hasSavedState tells whether an instance was stopped statefully and can be restored.
+func hasSavedState(instanceName string) bool {
+	info, err := os.Stat(instanceStateDir(instanceName))
+	return err == nil && info.IsDir()
+}
+
+// checkpointCommand returns the lxc-checkpoint command saving the state of an
+// instance into dir and stopping it.
+func checkpointCommand(instanceName, dir string) []string {
+	return []string{"lxc-checkpoint", "-n", instanceName, "-D", dir, "-s"}
+}
+
+// restoreCommand returns the lxc-checkpoint command starting an instance from the state in dir.
+func restoreCommand(instanceName, dir string) []string {
+	return []string{"lxc-checkpoint", "-n", instanceName, "-D", dir, "-r"}
+}
+
+// InstanceSnapshot describes a snapshot on /1.0/instances/{name}/snapshots/{snapshot}.
+// Snapshots are never stateful, Stateful is there for LXD clients.
+type InstanceSnapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Stateful  bool      `json:"stateful"`
+}
+
+// listSnapshots returns the lxc snapshots of an instance.
+func listSnapshots(instanceName string) ([]InstanceSnapshot, error) {
+	cmd := exec.Command("lxc-snapshot", "-n", instanceName, "-L")
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, actionError("list snapshots of", instanceName, err, stderr.String(), 0)
+	}
+
+	// Lines look like "snap0 (/var/lib/lxcsnaps/c1) 2024:05:01 12:00:00"
+	snapshots := []InstanceSnapshot{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == "No" {
+			continue
+		}
+		snapshot := InstanceSnapshot{Name: fields[0]}
+		if len(fields) >= 4 {
+			snapshot.CreatedAt, _ = time.ParseInLocation("2006:01:02 15:04:05", fields[2]+" "+fields[3], time.Local)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// SnapshotPayload is the body of POST /1.0/instances/{name}/snapshots.
+type SnapshotPayload struct {
+	Stateful bool `json:"stateful"`
+}
+
+// instanceSnapshotsHandler lists the snapshots of an instance on GET and
+// takes a snapshot on POST. lxc-snapshot names the snapshots itself, snap0,
+// snap1 and so on. Stateful snapshots are refused, there is no way to restore
+// them. GET /1.0/instances/{name}/snapshots/{snapshot} describes a single snapshot.
+func instanceSnapshotsHandler(w http.ResponseWriter, r *http.Request, instanceName string, path []string) {
+	if len(path) > 0 && path[len(path)-1] == "" {
+		path = path[:len(path)-1]
+	}
+	if len(path) > 1 {
+		notFound(w, "Not found")
+		return
+	}
+	if len(path) == 1 {
+		instanceSnapshotHandler(w, r, instanceName, path[0])
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		snapshots, err := listSnapshots(instanceName)
+		if err != nil {
+			smartError(w, err)
+			return
+		}
+		urls := []string{}
+		for _, snapshot := range snapshots {
+			urls = append(urls, "/1.0/instances/"+instanceName+"/snapshots/"+snapshot.Name)
+		}
+		json.NewEncoder(w).Encode(GeneralResponse{
+			Type:       "sync",
+			Status:     "Success",
+			StatusCode: 200,
+			Metadata:   urls,
+		})
+	case http.MethodPost:
+		var payload SnapshotPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		auditRecord := newAuditRecord(r, "instance-snapshot", "/1.0/instances/"+instanceName)
+
+		if payload.Stateful {
+			err := badRequestError("Stateful snapshots are not supported, they can't be restored")
+			auditRecord.finish(err)
+			smartError(w, err)
+			return
+		}
+
+		operationId := uuid.NewV4().String()
+		AddOperation(operationId, "task", OperationPending, instanceResources(instanceName), "Snapshotting instance", false)
+		RunOperation(operationId, func(ctx context.Context) error {
+			err := runLxcCommand(ctx, "snapshot", instanceName, []string{"lxc-snapshot", "-n", instanceName})
+			auditRecord.finish(err)
+			return err
+		})
+
+		metadata, _ := GetOperationMetadata(operationId)
+		w.Header().Set("Location", "/1.0/operations/"+operationId)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(GeneralResponse{
+			Type:       "async",
+			Status:     "Operation created",
+			StatusCode: 100,
+			Operation:  "/1.0/operations/" + operationId,
+			Metadata:   metadata,
+		})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// instanceSnapshotHandler serves a single snapshot of an instance.
+func instanceSnapshotHandler(w http.ResponseWriter, r *http.Request, instanceName, snapshotName string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	snapshots, err := listSnapshots(instanceName)
+	if err != nil {
+		smartError(w, err)
+		return
+	}
+	index := slices.IndexFunc(snapshots, func(snapshot InstanceSnapshot) bool { return snapshot.Name == snapshotName })
+	if index < 0 {
+		notFound(w, "Snapshot not found")
+		return
+	}
+	json.NewEncoder(w).Encode(GeneralResponse{
+		Type:       "sync",
+		Status:     "Success",
+		StatusCode: 200,
+		Metadata:   snapshots[index],
+	})
+}
+
+// runLxcCommand runs an lxc command for an action, failing with its stderr.
+func runLxcCommand(ctx context.Context, action, instanceName string, command []string) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	logOffset := lxcLogSize(instanceName)
+	err := cmd.Run()
+	if err != nil && ctx.Err() == nil {
+		return actionError(action, instanceName, err, stderr.String(), logOffset)
+	}
+	return err
+}
@@ -0,0 +1,273 @@
+package lxcapi
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// How much console output is kept per instance for GET /1.0/instances/{name}/console
+const consoleBufferSize = 256 << 10
+
+// ringBuffer keeps the last bytes written to it.
+type ringBuffer struct {
+	data []byte
+	size int
+}
+
+func (b *ringBuffer) Write(p []byte) {
+	b.data = append(b.data, p...)
+	if len(b.data) > b.size {
+		b.data = b.data[len(b.data)-b.size:]
+	}
+}
+
+func (b *ringBuffer) Bytes() []byte {
+	return append([]byte(nil), b.data...)
+}
+
+func (b *ringBuffer) Reset() {
+	b.data = nil
+}
+
+// consoleViewer is a console websocket attached to an instance console.
+type consoleViewer struct {
+	conn *websocket.Conn
+	rec  *recorder
+}
+
+// instanceConsole is the single lxc-console of an instance. Its output goes
+// to the buffer and to every attached viewer, and the input of all viewers
+// goes to the same pty. It keeps running when the viewers disconnect, so a
+// reconnecting browser gets the same console back. Clients catch up on what
+// they missed with GET /1.0/instances/{name}/console, like the UI does.
+type instanceConsole struct {
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	ptmx    *os.File
+	buffer  ringBuffer
+	viewers map[*consoleViewer]struct{}
+	// Stops lxc-console once nobody was attached for consoleIdleTimeout
+	idle *time.Timer
+	// Input of different viewers isn't interleaved
+	muInput sync.Mutex
+}
+
+var consoles = make(map[string]*instanceConsole)
+var muConsoles sync.Mutex
+
+// How long a console without viewers is kept running.
+var consoleIdleTimeout = 10 * time.Minute
+
+// SetConsoleIdleTimeout sets how long a console without viewers is kept running.
+func SetConsoleIdleTimeout(timeout time.Duration) {
+	consoleIdleTimeout = timeout
+}
+
+// instanceConsoleFor returns the console of an instance, and creates it if needed.
+func instanceConsoleFor(instanceName string) *instanceConsole {
+	muConsoles.Lock()
+	defer muConsoles.Unlock()
+
+	console, exists := consoles[instanceName]
+	if !exists {
+		console = &instanceConsole{
+			buffer:  ringBuffer{size: consoleBufferSize},
+			viewers: make(map[*consoleViewer]struct{}),
+		}
+		consoles[instanceName] = console
+	}
+	return console
+}
+
+// attachConsole attaches a viewer to the console of an instance and starts
+// lxc-console if it isn't running yet. It returns the pty of the console.
+func attachConsole(instanceName string, fds *Fds, viewer *consoleViewer) (*os.File, error) {
+	console := instanceConsoleFor(instanceName)
+
+	console.mu.Lock()
+	defer console.mu.Unlock()
+
+	if console.cmd == nil {
+		cmd := exec.Command("lxc-console", instanceName)
+		ptmx, err := startPty(cmd, fds)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to start console: %v", err)
+		}
+		console.cmd, console.ptmx = cmd, ptmx
+		go console.forward(cmd, ptmx)
+	}
+	if console.idle != nil {
+		console.idle.Stop()
+		console.idle = nil
+	}
+	console.viewers[viewer] = struct{}{}
+
+	return console.ptmx, nil
+}
+
+// detachConsole detaches a viewer. Once the last viewer is gone lxc-console
+// keeps running for consoleIdleTimeout, in case the client comes back.
+func detachConsole(instanceName string, viewer *consoleViewer) {
+	console := existingConsole(instanceName)
+	if console == nil {
+		return
+	}
+
+	console.mu.Lock()
+	defer console.mu.Unlock()
+
+	delete(console.viewers, viewer)
+	if len(console.viewers) == 0 && console.cmd != nil && console.idle == nil {
+		cmd := console.cmd
+		console.idle = time.AfterFunc(consoleIdleTimeout, func() {
+			console.mu.Lock()
+			defer console.mu.Unlock()
+			if console.cmd == cmd && len(console.viewers) == 0 {
+				cmd.Process.Kill()
+			}
+			console.idle = nil
+		})
+	}
+}
+
+// forward sends the output of lxc-console to the buffer and the viewers
+// until lxc-console is done, then closes the viewers.
+func (console *instanceConsole) forward(cmd *exec.Cmd, ptmx *os.File) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := ptmx.Read(buf)
+		if err != nil {
+			break
+		}
+
+		console.mu.Lock()
+		console.buffer.Write(buf[:n])
+		viewers := make([]*consoleViewer, 0, len(console.viewers))
+		for viewer := range console.viewers {
+			viewers = append(viewers, viewer)
+		}
+		console.mu.Unlock()
+
+		for _, viewer := range viewers {
+			viewer.rec.output(buf[:n])
+			// A stuck viewer is dropped instead of holding up the others
+			viewer.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			if err := viewer.conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				viewer.conn.Close()
+			}
+		}
+	}
+
+	cmd.Wait()
+	ptmx.Close()
+
+	console.mu.Lock()
+	if console.cmd == cmd {
+		console.cmd, console.ptmx = nil, nil
+		if console.idle != nil {
+			console.idle.Stop()
+			console.idle = nil
+		}
+	}
+	viewers := console.viewers
+	console.viewers = make(map[*consoleViewer]struct{})
+	console.mu.Unlock()
+
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "Console closed")
+	for viewer := range viewers {
+		viewer.conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+		viewer.conn.Close()
+	}
+}
+
+// input writes the input of a viewer to the console.
+func (console *instanceConsole) input(p []byte) error {
+	console.mu.Lock()
+	ptmx := console.ptmx
+	console.mu.Unlock()
+	if ptmx == nil {
+		return fmt.Errorf("Console is closed")
+	}
+
+	console.muInput.Lock()
+	defer console.muInput.Unlock()
+	_, err := ptmx.Write(p)
+	return err
+}
+
+// existingConsole returns the console of an instance, or nil if it never had one.
+func existingConsole(instanceName string) *instanceConsole {
+	muConsoles.Lock()
+	defer muConsoles.Unlock()
+
+	return consoles[instanceName]
+}
+
+// consoleLog returns the buffered console output of an instance. Without a
+// console opened since the daemon started, it is the end of the console.log
+// lxc-start writes.
+func consoleLog(instanceName string) []byte {
+	if console := existingConsole(instanceName); console != nil {
+		console.mu.Lock()
+		output := console.buffer.Bytes()
+		console.mu.Unlock()
+		if len(output) > 0 {
+			return output
+		}
+	}
+
+	dir, err := instanceLogDir(instanceName)
+	if err != nil {
+		return []byte{}
+	}
+	logFile, err := os.Open(filepath.Join(dir, "console.log"))
+	if err != nil {
+		return []byte{}
+	}
+	defer logFile.Close()
+	if info, err := logFile.Stat(); err == nil && info.Size() > consoleBufferSize {
+		logFile.Seek(info.Size()-consoleBufferSize, io.SeekStart)
+	}
+	output, _ := io.ReadAll(logFile)
+	return output
+}
+
+// clearConsoleLog empties the buffered console output of an instance and
+// its console.log.
+func clearConsoleLog(instanceName string) error {
+	if console := existingConsole(instanceName); console != nil {
+		console.mu.Lock()
+		console.buffer.Reset()
+		console.mu.Unlock()
+	}
+
+	dir, err := instanceLogDir(instanceName)
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(filepath.Join(dir, "console.log"), 0); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to clear the console log: %v", err)
+	}
+	return nil
+}
+
+// closeConsoles stops every lxc-console, on shutdown.
+func closeConsoles() {
+	muConsoles.Lock()
+	defer muConsoles.Unlock()
+
+	for _, console := range consoles {
+		console.mu.Lock()
+		if console.cmd != nil {
+			console.cmd.Process.Kill()
+		}
+		console.mu.Unlock()
+	}
+}
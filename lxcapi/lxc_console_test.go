@@ -0,0 +1,119 @@
+package lxcapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeLxcConsole puts an lxc-console on PATH that prints a line every 50ms.
+func fakeLxcConsole(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\nwhile :; do echo tick; sleep 0.05; done\n"
+	if err := os.WriteFile(filepath.Join(dir, "lxc-console"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+}
+
+// openConsole creates a console operation and connects a viewer to it.
+func openConsole(t *testing.T, server *httptest.Server, instanceName string) (string, *websocket.Conn) {
+	r := httptest.NewRequest(http.MethodPost, "/1.0/instances/"+instanceName+"/console", strings.NewReader("{}"))
+	_, _, _, op, _, _, _, err := putInstanceExecAction(instanceName, r, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operationID := strings.TrimPrefix(op, "/1.0/operations/")
+	fds, err := GetFds(operationID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + op + "/websocket?secret=" + fds.Data
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return operationID, conn
+}
+
+func TestConsoleCancelKeepsOtherViewers(t *testing.T) {
+	fakeLxcConsole(t)
+	server := httptest.NewServer(http.HandlerFunc(OperationHandler))
+	defer server.Close()
+	defer closeConsoles()
+
+	first, firstConn := openConsole(t, server, "console-test")
+	second, secondConn := openConsole(t, server, "console-test")
+
+	for _, conn := range []*websocket.Conn{firstConn, secondConn} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatalf("No console output before cancelling: %v", err)
+		}
+	}
+
+	// Every viewer can resize the shared pty
+	if err := resizeSession(first, 100, 30); err != nil {
+		t.Fatalf("Unable to resize the console: %v", err)
+	}
+
+	if err := CancelOperation(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cancelled viewer is disconnected
+	firstConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := firstConn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	// The other one keeps getting output from the same lxc-console
+	secondConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 5; i++ {
+		if _, _, err := secondConn.ReadMessage(); err != nil {
+			t.Fatalf("Console output stopped for the other viewer: %v", err)
+		}
+	}
+	if err := resizeSession(second, 80, 24); err != nil {
+		t.Fatalf("Unable to resize the console of the other viewer: %v", err)
+	}
+}
+
+func TestConsoleLogFromFile(t *testing.T) {
+	defer SetLogsDir(logsDir)
+	SetLogsDir(t.TempDir())
+
+	dir, err := instanceLogDir("console-log-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "console.log")
+	if err := os.WriteFile(file, []byte("booted\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nobody opened the console since the daemon started
+	if output := string(consoleLog("console-log-test")); output != "booted\n" {
+		t.Fatalf("consoleLog() = %q, want the content of console.log", output)
+	}
+
+	if err := clearConsoleLog("console-log-test"); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(file); err != nil || info.Size() != 0 {
+		t.Fatalf("console.log is not empty after clearing it: %v", err)
+	}
+	if output := consoleLog("console-log-test"); len(output) != 0 {
+		t.Fatalf("consoleLog() = %q after clearing it", output)
+	}
+}
@@ -0,0 +1,217 @@
+package lxcapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Events waiting for a subscriber before it is considered too slow
+	eventQueueSize = 128
+	// How long a single event may take to be written
+	eventWriteTimeout = 5 * time.Second
+)
+
+type eventSubscriber struct {
+	conn      *websocket.Conn
+	types     map[string]bool
+	project   string
+	logLevel  slog.Level
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[*eventSubscriber]struct{}
+}
+
+var events = &eventHub{subscribers: make(map[*eventSubscriber]struct{})}
+
+// wants tells whether the subscriber asked for events of this type and project.
+// An empty type list means all types, an empty project means all projects.
+func (s *eventSubscriber) wants(eventType, project string) bool {
+	if len(s.types) > 0 && !s.types[eventType] {
+		return false
+	}
+	return s.project == "" || project == "" || s.project == project
+}
+
+// writer is the only goroutine writing to the subscriber's connection.
+func (s *eventSubscriber) writer() {
+	for {
+		select {
+		case message := <-s.queue:
+			s.conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := s.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				slog.Debug("Unable to send event", "remote", s.conn.RemoteAddr().String(), "err", err)
+				events.unsubscribe(s)
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *eventSubscriber) close(reason string) {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		message := websocket.FormatCloseMessage(websocket.CloseGoingAway, reason)
+		s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+		s.conn.Close()
+	})
+}
+
+func (h *eventHub) subscribe(conn *websocket.Conn, types []string, project string, logLevel slog.Level) *eventSubscriber {
+	subscriber := &eventSubscriber{
+		conn:     conn,
+		types:    make(map[string]bool),
+		project:  project,
+		logLevel: logLevel,
+		queue:    make(chan []byte, eventQueueSize),
+		done:     make(chan struct{}),
+	}
+	for _, eventType := range types {
+		subscriber.types[eventType] = true
+	}
+
+	h.mu.Lock()
+	h.subscribers[subscriber] = struct{}{}
+	h.mu.Unlock()
+
+	go subscriber.writer()
+	return subscriber
+}
+
+func (h *eventHub) unsubscribe(subscriber *eventSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, subscriber)
+	h.mu.Unlock()
+
+	subscriber.close("Unsubscribed")
+}
+
+// publish queues a message for every interested subscriber without blocking.
+// Subscribers whose queue is full are disconnected.
+func (h *eventHub) publish(eventType, project string, message []byte) {
+	h.publishTo(func(subscriber *eventSubscriber) bool {
+		return subscriber.wants(eventType, project)
+	}, message)
+}
+
+// publishLogging queues a logging event for the subscribers that want its level.
+func (h *eventHub) publishLogging(level slog.Level, message []byte) {
+	h.publishTo(func(subscriber *eventSubscriber) bool {
+		return subscriber.wants("logging", "") && level >= subscriber.logLevel
+	}, message)
+}
+
+// wantsLogging tells whether any subscriber would receive a record of this level.
+func (h *eventHub) wantsLogging(level slog.Level) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for subscriber := range h.subscribers {
+		if subscriber.wants("logging", "") && level >= subscriber.logLevel {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *eventHub) publishTo(filter func(*eventSubscriber) bool, message []byte) {
+	var slow []*eventSubscriber
+
+	h.mu.Lock()
+	for subscriber := range h.subscribers {
+		if !filter(subscriber) {
+			continue
+		}
+		select {
+		case subscriber.queue <- message:
+		default:
+			slow = append(slow, subscriber)
+		}
+	}
+	h.mu.Unlock()
+
+	for _, subscriber := range slow {
+		h.unsubscribe(subscriber)
+		slog.Warn("Disconnected slow event subscriber", "remote", subscriber.conn.RemoteAddr().String())
+	}
+}
+
+func (h *eventHub) closeAll(reason string) {
+	h.mu.Lock()
+	subscribers := h.subscribers
+	h.subscribers = make(map[*eventSubscriber]struct{})
+	h.mu.Unlock()
+
+	for subscriber := range subscribers {
+		subscriber.close(reason)
+	}
+}
+
+// sendEvent sends an event to every subscriber of its type and project.
+func sendEvent(eventType, project string, message any) error {
+	messageData, err := json.Marshal(message)
+	if err != nil {
+		slog.Error("Unable to marshal event", "type", eventType, "err", err)
+		return err
+	}
+	events.publish(eventType, project, messageData)
+	return nil
+}
+
+// HandleOperationsWebSocket serves /1.0/events?type=operation,logging,lifecycle&project=default.
+// Logging subscribers can pass level=debug|info|warning|error, the default is info.
+func HandleOperationsWebSocket(w http.ResponseWriter, r *http.Request) {
+	if !IsTrusted(r) {
+		forbidden(w)
+		return
+	}
+
+	var types []string
+	for _, eventType := range strings.Split(r.URL.Query().Get("type"), ",") {
+		if eventType = strings.TrimSpace(eventType); eventType != "" {
+			types = append(types, eventType)
+		}
+	}
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		project = "default"
+	}
+	if r.URL.Query().Get("all-projects") == "true" {
+		project = ""
+	}
+	logLevel, err := parseLogLevel(r.URL.Query().Get("level"))
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Warn("Unable to upgrade websocket", "path", r.URL.Path, "err", err)
+		return
+	}
+
+	subscriber := events.subscribe(conn, types, project, logLevel)
+	slog.Debug("Event websocket connected", "remote", r.RemoteAddr, "types", types, "project", project)
+
+	// Clients don't send anything, reading only notices when they go away
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	events.unsubscribe(subscriber)
+}
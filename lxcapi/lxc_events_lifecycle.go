@@ -0,0 +1,64 @@
+package lxcapi
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Lifecycle actions, named like LXD's
+const (
+	lifecycleInstanceCreated    = "instance-created"
+	lifecycleInstanceDeleted    = "instance-deleted"
+	lifecycleInstanceStarted    = "instance-started"
+	lifecycleInstanceStopped    = "instance-stopped"
+	lifecycleInstanceRestarted  = "instance-restarted"
+	lifecycleInstancePaused     = "instance-paused"
+	lifecycleInstanceResumed    = "instance-resumed"
+	lifecycleInstanceExec       = "instance-exec"
+	lifecycleInstanceConsole    = "instance-console"
+	lifecycleCertificateCreated = "certificate-created"
+)
+
+// instanceStateLifecycle maps the actions of PUT /1.0/instances/{name}/state to their event.
+var instanceStateLifecycle = map[string]string{
+	"start":    lifecycleInstanceStarted,
+	"stop":     lifecycleInstanceStopped,
+	"restart":  lifecycleInstanceRestarted,
+	"freeze":   lifecycleInstancePaused,
+	"unfreeze": lifecycleInstanceResumed,
+}
+
+// requestorFromRequest returns the authenticated client of r for lifecycle events.
+func requestorFromRequest(r *http.Request) *EventRequestor {
+	username, protocol := ClientIdentity(r)
+	if username == "" {
+		return nil
+	}
+	return &EventRequestor{
+		Username: username,
+		Protocol: protocol,
+		Address:  r.RemoteAddr,
+	}
+}
+
+// SendLifecycleEvent tells the lifecycle subscribers that source changed.
+// requestor is nil for changes that were not made through the API.
+func SendLifecycleEvent(action, source string, requestor *EventRequestor, context map[string]any) error {
+	message := LifecycleResponse{
+		Type:      "lifecycle",
+		Timestamp: time.Now().UTC(),
+		Metadata: LifecycleMetadata{
+			Action:    action,
+			Source:    source,
+			Context:   context,
+			Requestor: requestor,
+			Name:      source[strings.LastIndex(source, "/")+1:],
+			Project:   "default",
+		},
+		Location: "none",
+		Project:  "default",
+	}
+
+	return sendEvent(message.Type, message.Project, message)
+}
@@ -0,0 +1,135 @@
+package lxcapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+type LoggingMetadata struct {
+	Message string            `json:"message"`
+	Level   string            `json:"level"`
+	Context map[string]string `json:"context"`
+}
+
+type LoggingResponse struct {
+	Type      string          `json:"type"`
+	Timestamp time.Time       `json:"timestamp"`
+	Metadata  LoggingMetadata `json:"metadata"`
+	Location  string          `json:"location"`
+	Project   string          `json:"project"`
+}
+
+// eventLogHandler passes log records on to the next handler and also sends
+// them to the /1.0/events subscribers of logging events.
+type eventLogHandler struct {
+	next   slog.Handler
+	attrs  []slog.Attr
+	prefix string
+}
+
+// NewEventLogHandler wraps next so the server's own logs show up as LXD
+// logging events.
+func NewEventLogHandler(next slog.Handler) slog.Handler {
+	return &eventLogHandler{next: next}
+}
+
+func (h *eventLogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level) || events.wantsLogging(level)
+}
+
+func (h *eventLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	var err error
+	if h.next.Enabled(ctx, record.Level) {
+		err = h.next.Handle(ctx, record)
+	}
+
+	if !events.wantsLogging(record.Level) {
+		return err
+	}
+
+	logContext := make(map[string]string)
+	for _, attr := range h.attrs {
+		addLogContext(logContext, "", attr)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		addLogContext(logContext, h.prefix, attr)
+		return true
+	})
+
+	message := LoggingResponse{
+		Type:      "logging",
+		Timestamp: record.Time.UTC(),
+		Metadata: LoggingMetadata{
+			Message: record.Message,
+			Level:   lxdLogLevel(record.Level),
+			Context: logContext,
+		},
+		Location: "none",
+		Project:  "",
+	}
+	messageData, marshalErr := json.Marshal(message)
+	if marshalErr != nil {
+		return err
+	}
+	events.publishLogging(record.Level, messageData)
+
+	return err
+}
+
+func (h *eventLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	prefixed = append(prefixed, h.attrs...)
+	for _, attr := range attrs {
+		prefixed = append(prefixed, slog.Attr{Key: h.prefix + attr.Key, Value: attr.Value})
+	}
+	return &eventLogHandler{next: h.next.WithAttrs(attrs), attrs: prefixed, prefix: h.prefix}
+}
+
+func (h *eventLogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &eventLogHandler{next: h.next.WithGroup(name), attrs: h.attrs, prefix: h.prefix + name + "."}
+}
+
+func addLogContext(logContext map[string]string, prefix string, attr slog.Attr) {
+	value := attr.Value.Resolve()
+	if value.Kind() == slog.KindGroup {
+		for _, groupAttr := range value.Group() {
+			addLogContext(logContext, prefix+attr.Key+".", groupAttr)
+		}
+		return
+	}
+	logContext[prefix+attr.Key] = value.String()
+}
+
+// lxdLogLevel returns the level names used by LXD.
+func lxdLogLevel(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return "error"
+	case level >= slog.LevelWarn:
+		return "warning"
+	case level >= slog.LevelInfo:
+		return "info"
+	}
+	return "debug"
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("Unknown log level %q", level)
+}
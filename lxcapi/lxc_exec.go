@@ -0,0 +1,381 @@
+package lxcapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+)
+
+// execStreams are the stdin, stdout and stderr websockets of a non-interactive
+// exec. The command is started once all of them are connected.
+type execStreams struct {
+	conns    map[string]*websocket.Conn
+	finished chan struct{}
+}
+
+var pendingExecStreams = make(map[string]*execStreams)
+var muExecStreams sync.Mutex
+
+// attachCommand returns the lxc-attach command running the exec in the instance.
+// lxc-attach has no working directory option, so a cwd is entered by a shell
+// in the instance. The cwd and the command are passed to it as arguments and
+// never become part of the script.
+func attachCommand(ctx context.Context, instanceName string, fds *Fds) *exec.Cmd {
+	args := []string{instanceName}
+	for key, value := range fds.Environment {
+		args = append(args, "-v", fmt.Sprintf("%s=%s", key, value))
+	}
+	args = append(args, "-u", fmt.Sprint(fds.User), "-g", fmt.Sprint(fds.Group), "--clear-env", "--")
+	if fds.Cwd != "" {
+		args = append(args, "/bin/sh", "-c", `cd -- "$1" && shift && exec "$@"`, "sh", fds.Cwd)
+	}
+	args = append(args, fds.Command...)
+	return exec.CommandContext(ctx, "lxc-attach", args...)
+}
+
+// startPty starts cmd on a pty of the size asked for by the client, if any.
+func startPty(cmd *exec.Cmd, fds *Fds) (*os.File, error) {
+	if fds.Width > 0 && fds.Height > 0 && fds.Width <= 0xffff && fds.Height <= 0xffff {
+		return pty.StartWithSize(cmd, &pty.Winsize{Rows: uint16(fds.Height), Cols: uint16(fds.Width)})
+	}
+	return pty.Start(cmd)
+}
+
+// handleExecStream connects the websocket of one fd of a non-interactive exec.
+// The last websocket to connect runs the command, the others wait for it.
+func handleExecStream(operationID, instanceName string, fds *Fds, fd string, conn *websocket.Conn) {
+	changed := operationChanged(operationID)
+
+	muExecStreams.Lock()
+	streams, exists := pendingExecStreams[operationID]
+	if !exists {
+		streams = &execStreams{conns: make(map[string]*websocket.Conn), finished: make(chan struct{})}
+		pendingExecStreams[operationID] = streams
+	}
+	streams.conns[fd] = conn
+	complete := len(streams.conns) == 3
+	if complete {
+		delete(pendingExecStreams, operationID)
+	}
+	muExecStreams.Unlock()
+
+	if complete {
+		runExecStreams(operationID, instanceName, fds, streams)
+		return
+	}
+
+	select {
+	case <-streams.finished:
+	case <-changed:
+		// Cancelled or timed out before every websocket was connected
+		muExecStreams.Lock()
+		delete(pendingExecStreams, operationID)
+		muExecStreams.Unlock()
+	}
+}
+
+// runExecStreams runs a non-interactive exec with its output sent to the
+// websockets, and to the log files if the output is recorded.
+func runExecStreams(operationID, instanceName string, fds *Fds, streams *execStreams) {
+	defer close(streams.finished)
+	defer DeleteFds(operationID)
+
+	cmd := attachCommand(context.Background(), instanceName, fds)
+	// Without a pty there is no setsid, signals go to a process group of its own
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		UpdateOperation(operationID, OperationFailure, err.Error())
+		return
+	}
+	stdout := &websocketWriter{conn: streams.conns["1"]}
+	stderr := &websocketWriter{conn: streams.conns["2"]}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	var output map[string]string
+	if fds.RecordOutput {
+		stdoutFile, stderrFile, recorded, err := openExecOutput(operationID, instanceName)
+		if err != nil {
+			UpdateOperation(operationID, OperationFailure, err.Error())
+			return
+		}
+		defer stdoutFile.Close()
+		defer stderrFile.Close()
+		stdout.record, stderr.record = stdoutFile, stderrFile
+		output = recorded
+	}
+
+	if err := cmd.Start(); err != nil {
+		UpdateOperation(operationID, OperationFailure, err.Error())
+		return
+	}
+	AddSession(operationID, nil, cmd, streams.conns["0"], streams.conns["1"], streams.conns["2"])
+	defer DeleteSession(operationID)
+
+	// An empty message or a closed websocket ends stdin
+	go func() {
+		defer stdin.Close()
+		for {
+			_, msg, err := streams.conns["0"].ReadMessage()
+			if err != nil || len(msg) == 0 {
+				return
+			}
+			if _, err := stdin.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	code, err := exitCode(cmd.Wait())
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	for _, conn := range streams.conns {
+		conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+	}
+	finishExec(operationID, code, output, err)
+}
+
+// runExecDetached runs a non-interactive exec without websockets,
+// its output is discarded unless it is recorded.
+func runExecDetached(ctx context.Context, operationID, instanceName string, fds *Fds) error {
+	cmd := attachCommand(ctx, instanceName, fds)
+
+	var output map[string]string
+	if fds.RecordOutput {
+		stdoutFile, stderrFile, recorded, err := openExecOutput(operationID, instanceName)
+		if err != nil {
+			return err
+		}
+		defer stdoutFile.Close()
+		defer stderrFile.Close()
+		cmd.Stdout, cmd.Stderr = stdoutFile, stderrFile
+		output = recorded
+	}
+
+	code, err := exitCode(cmd.Run())
+	if err != nil {
+		return err
+	}
+	setExecResult(operationID, code, output)
+	return nil
+}
+
+// openExecOutput creates the files the output of an exec is recorded in,
+// and returns them with their URLs by fd.
+func openExecOutput(operationID, instanceName string) (*os.File, *os.File, map[string]string, error) {
+	dir, err := instanceLogDir(instanceName, "exec-output")
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	url := "/1.0/instances/" + instanceName + "/logs/exec-output/"
+	output := make(map[string]string)
+	var files []*os.File
+	for _, stream := range []struct{ fd, name string }{{"1", "stdout"}, {"2", "stderr"}} {
+		name := fmt.Sprintf("exec_%s.%s", operationID, stream.name)
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+		if err != nil {
+			for _, opened := range files {
+				opened.Close()
+			}
+			return nil, nil, nil, fmt.Errorf("Unable to record exec output: %v", err)
+		}
+		files = append(files, file)
+		output[stream.fd] = url + name
+	}
+
+	return files[0], files[1], output, nil
+}
+
+// exitCode returns the exit code of a finished command. A command killed by a
+// signal exits with 128 plus the signal, like in a shell.
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return -1, err
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal()), nil
+	}
+	return exitErr.ExitCode(), nil
+}
+
+// finishExec ends the operation of an exec once its command is done.
+// A non-zero exit code is a result of the command, not a failure of the operation.
+func finishExec(operationID string, code int, output map[string]string, err error) {
+	if err != nil {
+		UpdateOperation(operationID, OperationFailure, err.Error())
+		return
+	}
+	setExecResult(operationID, code, output)
+	UpdateOperation(operationID, OperationSuccess, "")
+}
+
+// setExecResult adds the exit code and the recorded output to the exec metadata.
+func setExecResult(operationID string, code int, output map[string]string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	operation, exists := Operations[operationID]
+	if !exists {
+		return
+	}
+	if metadata, ok := operation.Metadata.(MetadataInMetadata); ok {
+		metadata.Return = &code
+		metadata.Output = output
+		operation.Metadata = metadata
+	}
+}
+
+// websocketWriter sends the output of a command to a websocket. Once the
+// websocket is gone the output is still consumed, so the command never blocks.
+type websocketWriter struct {
+	conn   *websocket.Conn
+	record *os.File
+	failed bool
+}
+
+func (writer *websocketWriter) Write(p []byte) (int, error) {
+	if writer.record != nil {
+		writer.record.Write(p)
+	}
+	if !writer.failed {
+		if err := writer.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+			writer.failed = true
+		}
+	}
+	return len(p), nil
+}
+
+// controlMessage is a message of the control websocket of an exec or console.
+type controlMessage struct {
+	Command string            `json:"command"`
+	Args    map[string]string `json:"args"`
+	Signal  int               `json:"signal"`
+}
+
+// handleExecControl applies the window-resize and signal messages of the
+// control websocket to the session, until the client or the session is done.
+func handleExecControl(operationID string, conn *websocket.Conn) {
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		for {
+			select {
+			case <-finished:
+				return
+			case <-operationChanged(operationID):
+			}
+			metadata, err := GetOperationMetadata(operationID)
+			if err == nil && !OperationStatus(metadata.StatusCode).isFinal() {
+				continue
+			}
+			closeMessage := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(time.Second))
+			conn.Close()
+			return
+		}
+	}()
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var control controlMessage
+		if err := json.Unmarshal(msg, &control); err != nil {
+			slog.Debug("Bad control message", "operation", operationID, "err", err)
+			continue
+		}
+
+		switch control.Command {
+		case "window-resize":
+			width, _ := strconv.Atoi(control.Args["width"])
+			height, _ := strconv.Atoi(control.Args["height"])
+			err = resizeSession(operationID, width, height)
+		case "signal":
+			err = signalSession(operationID, syscall.Signal(control.Signal))
+		default:
+			err = fmt.Errorf("Unknown control command %q", control.Command)
+		}
+		if err != nil {
+			slog.Debug("Unable to apply control message", "operation", operationID, "err", err)
+		}
+	}
+}
+
+// resizeSession sets the terminal size of an interactive session.
+func resizeSession(operationID string, width, height int) error {
+	if width <= 0 || height <= 0 || width > 0xffff || height > 0xffff {
+		return fmt.Errorf("Bad window size %dx%d", width, height)
+	}
+
+	muSessions.Lock()
+	session, exists := Sessions[operationID]
+	muSessions.Unlock()
+	if !exists || session.Ptmx == nil {
+		return fmt.Errorf("No terminal for operation %s", operationID)
+	}
+
+	if err := pty.Setsize(session.Ptmx, &pty.Winsize{Rows: uint16(height), Cols: uint16(width)}); err != nil {
+		return err
+	}
+	activeRecording(operationID).resize(width, height)
+	return nil
+}
+
+// signalSession sends a signal to the process group of a session.
+func signalSession(operationID string, signal syscall.Signal) error {
+	if signal <= 0 || signal > 64 {
+		return fmt.Errorf("Bad signal %d", signal)
+	}
+
+	muSessions.Lock()
+	session, exists := Sessions[operationID]
+	muSessions.Unlock()
+	if !exists {
+		return fmt.Errorf("No process for operation %s", operationID)
+	}
+
+	// Like Ctrl-C in a terminal the signal goes to the foreground process
+	// group of the pty. Sessions without a pty have a process group of their own.
+	pgid := 0
+	if session.Cmd != nil && session.Cmd.Process != nil {
+		pgid = session.Cmd.Process.Pid
+	}
+	if session.Ptmx != nil {
+		if foreground, err := foregroundProcessGroup(session.Ptmx); err == nil {
+			pgid = foreground
+		}
+	}
+	if pgid <= 0 {
+		return fmt.Errorf("No process for operation %s", operationID)
+	}
+	return syscall.Kill(-pgid, signal)
+}
+
+// foregroundProcessGroup returns the foreground process group of a pty.
+func foregroundProcessGroup(ptmx *os.File) (int, error) {
+	var pgid int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, ptmx.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgid)))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgid), nil
+}
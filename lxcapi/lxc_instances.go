@@ -3,11 +3,16 @@ package lxcapi
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"os/exec"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -84,11 +89,26 @@ type Device struct {
 	Pool    string `json:"pool,omitempty"`
 }
 
+// StatePayload is the body of PUT /1.0/instances/{name}/state.
+type StatePayload struct {
+	Action   string `json:"action"`
+	Timeout  int    `json:"timeout"`
+	Force    bool   `json:"force"`
+	Stateful bool   `json:"stateful"`
+}
+
 type ExecPayload struct {
 	Command     []string          `json:"command"`
 	Environment map[string]string `json:"environment"`
 	User        int               `json:"user"`
 	Group       int               `json:"group"`
+	Cwd         string            `json:"cwd"`
+	Width       int               `json:"width"`
+	Height      int               `json:"height"`
+	// Clients that don't send it get a pty, as they always did
+	Interactive      *bool `json:"interactive"`
+	WaitForWebsocket bool  `json:"wait-for-websocket"`
+	RecordOutput     bool  `json:"record-output"`
 }
 
 var defaultExecEnv = map[string]string{
@@ -99,128 +119,269 @@ var defaultExecEnv = map[string]string{
 	"USER": "root",
 }
 
+// instanceMethods are the methods each instance route answers to, by action.
+// Snapshots and logs check their own.
+var instanceMethods = map[string][]string{
+	"":         {http.MethodGet},
+	"forwards": {http.MethodGet},
+	"state":    {http.MethodGet, http.MethodPut},
+	"exec":     {http.MethodPost},
+	"console":  {http.MethodGet, http.MethodDelete, http.MethodPost},
+}
+
 // InstancesHandler handles the synchronization request. It processes the HTTP request
 // and sends the appropriate response back to the client.
 func InstancesHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	path := r.URL.Path
-	fmt.Println("Request Method:", r.Method, "|", "Request API:", path)
-	parts := strings.Split(path, "/")
-	var instanceName, instanceAction string
 	var opType, opStatus, opSC, op, opEC, opE = "sync", "Success", 100, "", 0, ""
 	var instanceData any
-	var err error
-	var requestData map[string]any
-	if len(parts) == 4 {
-		instanceName = parts[3]
-	} else if len(parts) >= 4 {
-		instanceName = parts[3]
-		instanceAction = parts[4]
+	if !IsTrusted(r) {
+		forbidden(w)
+		return
+	}
+
+	instanceName, instanceAction, rest, err := parseInstancePath(r.URL.Path)
+	if err != nil {
+		smartError(w, err)
+		return
 	}
 
 	//recursion := r.URL.Query().Get("recursion")
 	//project := r.URL.Query().Get("project")
 
-	if IsTrusted(r) {
-		// 获取实例元数据
-		if instanceName == "" && instanceAction == "" {
-			instanceData, err = getInstanceInfo(instanceName)
-		} else if instanceName != "" && instanceAction == "" {
-			instanceData, err = getInstanceInfo(instanceName)
-		} else if instanceName != "" && instanceAction == "forwards" {
-			instanceData = []string{}
-		} else if instanceName != "" && instanceAction == "state" && r.Method == http.MethodGet {
-			instanceData, err = getInstanceInfo(instanceName)
-		} else if instanceName != "" && instanceAction == "state" && r.Method == http.MethodPut {
-			json.NewDecoder(r.Body).Decode(&requestData)
-			action, _ := requestData["action"].(string)
-			opType, opStatus, opSC, op, opEC, opE, instanceData, err = putInstanceAction(instanceName, action)
-		} else if instanceName != "" && instanceAction == "exec" && r.Method == http.MethodPost {
-			opType, opStatus, opSC, op, opEC, opE, instanceData, err = putInstanceExecAction(instanceName, r, false)
-		} else if instanceName != "" && instanceAction == "console" && r.Method == http.MethodGet {
-			w.Header().Set("Content-Type", "application/octet-stream")
-			data := []byte{0x54, 0x68, 0x69, 0x73, 0x20, 0x6c, 0x78, 0x63, 0x2d, 0x75, 0x69, 0x2d, 0x61, 0x70, 0x69, 0x21, 0x0a}
-			w.Write(data)
-			return
-		} else if instanceName != "" && instanceAction == "console" && r.Method == http.MethodPost {
-			opType, opStatus, opSC, op, opEC, opE, instanceData, err = putInstanceExecAction(instanceName, r, true)
-		} else {
-			instanceData, err = getNetworkInterfaceInfo(instanceName)
-		}
+	if methods, known := instanceMethods[instanceAction]; known && !slices.Contains(methods, r.Method) {
+		methodNotAllowed(w)
+		return
+	}
 
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error retrieving network interfaces: %v", err), http.StatusInternalServerError)
+	if instanceName != "" {
+		if err := checkInstanceExists(instanceName); err != nil {
+			smartError(w, err)
 			return
 		}
+	}
 
-		response := GeneralResponse{
-			Type:       opType,
-			Status:     opStatus,
-			StatusCode: opSC,
-			Operation:  op,
-			ErrorCode:  opEC,
-			Error:      opE,
-			Metadata:   instanceData,
-		}
-
-		// 编码并写入响应
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
-		}
+	// 获取实例元数据
+	if instanceName == "" && instanceAction == "" {
+		instanceData, err = getInstanceInfo(instanceName)
+	} else if instanceName != "" && instanceAction == "" {
+		instanceData, err = getInstanceInfo(instanceName)
+	} else if instanceName != "" && instanceAction == "forwards" {
+		instanceData = []string{}
+	} else if instanceName != "" && instanceAction == "state" && r.Method == http.MethodGet {
+		instanceData, err = getInstanceInfo(instanceName)
+	} else if instanceName != "" && instanceAction == "state" && r.Method == http.MethodPut {
+		var payload StatePayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		opType, opStatus, opSC, op, opEC, opE, instanceData, err = putInstanceAction(instanceName, payload, r)
+	} else if instanceName != "" && instanceAction == "exec" && r.Method == http.MethodPost {
+		opType, opStatus, opSC, op, opEC, opE, instanceData, err = putInstanceExecAction(instanceName, r, false)
+		Audit(r, "instance-exec", "/1.0/instances/"+instanceName, auditError(opE, err))
+	} else if instanceName != "" && instanceAction == "snapshots" {
+		instanceSnapshotsHandler(w, r, instanceName, rest)
+		return
+	} else if instanceName != "" && instanceAction == "logs" {
+		instanceLogsHandler(w, r, instanceName, rest)
+		return
+	} else if instanceName != "" && instanceAction == "console" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(consoleLog(instanceName))
+		return
+	} else if instanceName != "" && instanceAction == "console" && r.Method == http.MethodDelete {
+		err = clearConsoleLog(instanceName)
+		Audit(r, "instance-console-clear", "/1.0/instances/"+instanceName, err)
+		instanceData = map[string]any{}
+	} else if instanceName != "" && instanceAction == "console" && r.Method == http.MethodPost {
+		opType, opStatus, opSC, op, opEC, opE, instanceData, err = putInstanceExecAction(instanceName, r, true)
+		Audit(r, "instance-console", "/1.0/instances/"+instanceName, auditError(opE, err))
 	} else {
-		http.Error(w, "TLS certificate missing", http.StatusUnauthorized)
+		notFound(w, "Not found")
+		return
+	}
+
+	if err != nil {
+		smartError(w, err)
+		return
+	}
+
+	if opType == "async" {
+		w.Header().Set("Location", op)
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	response := GeneralResponse{
+		Type:       opType,
+		Status:     opStatus,
+		StatusCode: opSC,
+		Operation:  op,
+		ErrorCode:  opEC,
+		Error:      opE,
+		Metadata:   instanceData,
+	}
+
+	// 编码并写入响应
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
 	}
 }
 
-func putInstanceAction(instanceName, action string) (string, string, int, string, int, string, any, error) {
-	var cmd *exec.Cmd
-	operationId := uuid.NewV4().String()
-	description := charCases(action) + " instance"
-	AddOperation(operationId, "task", "Running", instanceName, description, false)
+func putInstanceAction(instanceName string, payload StatePayload, r *http.Request) (string, string, int, string, int, string, any, error) {
+	var commands [][]string
+	// Runs once all the commands succeeded
+	var onSuccess func() error
+	// Removed once the operation is over, whether it succeeded or not
+	var pendingDir string
+	action := payload.Action
+	// Only known actions make it into the audit log
+	if _, known := instanceStateLifecycle[action]; !known {
+		return "", "", 0, "", 0, "", nil, badRequestError("Unsupported action %q", action)
+	}
+	auditRecord := newAuditRecord(r, "instance-"+action, "/1.0/instances/"+instanceName)
+
+	if payload.Stateful && action != "stop" && action != "start" {
+		err := badRequestError("Only stop and start can be stateful, not %s", action)
+		auditRecord.finish(err)
+		return "", "", 0, "", 0, "", nil, err
+	}
+	if payload.Stateful {
+		err := checkCRIU()
+		if err == nil && action == "stop" && instanceState(instanceName) != "RUNNING" {
+			err = conflictError("Instance %s must be running for a stateful stop", instanceName)
+		}
+		if err == nil && action == "start" && !hasSavedState(instanceName) {
+			err = badRequestError("Instance %s has no saved state to restore", instanceName)
+		}
+		if err != nil {
+			auditRecord.finish(err)
+			return "", "", 0, "", 0, "", nil, err
+		}
+	}
 
 	switch action {
 	case "stop":
-		cmd = exec.Command("sh", "-c", "lxc-unfreeze "+instanceName+" && lxc-stop "+instanceName)
+		commands = [][]string{lxcStopCommand(instanceName, payload)}
+		if payload.Stateful {
+			// The state is only saved for the next start once the checkpoint
+			// succeeded, a failed one must not look like a saved state
+			stateDir := instanceStateDir(instanceName)
+			pendingDir = stateDir + ".pending-" + uuid.NewV4().String()
+			if err := os.MkdirAll(pendingDir, 0700); err != nil {
+				err = fmt.Errorf("Unable to create state directory: %v", err)
+				auditRecord.finish(err)
+				return "", "", 0, "", 0, "", nil, err
+			}
+			commands = [][]string{checkpointCommand(instanceName, pendingDir)}
+			onSuccess = func() error {
+				os.RemoveAll(stateDir)
+				if err := os.Rename(pendingDir, stateDir); err != nil {
+					return fmt.Errorf("Unable to save the state of instance %s: %v", instanceName, err)
+				}
+				return nil
+			}
+		}
 	case "start":
-		cmd = exec.Command("lxc-start", instanceName)
+		commands = [][]string{lxcStartCommand(instanceName)}
+		if payload.Stateful {
+			commands = [][]string{restoreCommand(instanceName, instanceStateDir(instanceName))}
+		}
+		// The saved state is used up, or stale once the instance started afresh
+		onSuccess = func() error { return os.RemoveAll(instanceStateDir(instanceName)) }
 	case "restart":
-		cmd = exec.Command("sh", "-c", "lxc-stop "+instanceName+" && lxc-start "+instanceName)
-	case "freeze":
-		cmd = exec.Command("lxc-freeze", instanceName)
-	case "unfreeze":
-		cmd = exec.Command("lxc-unfreeze", instanceName)
-	default:
-		return "", "Unsupported action", 400, "", 1, "Unsupported action", map[string]any{}, nil
+		commands = [][]string{lxcStopCommand(instanceName, payload), lxcStartCommand(instanceName)}
+	case "freeze", "unfreeze":
+		// Only a running instance can be frozen, and only a frozen one thawed
+		wantState := "RUNNING"
+		if action == "unfreeze" {
+			wantState = "FROZEN"
+		}
+		if state := instanceState(instanceName); state != wantState {
+			err := conflictError("Instance %s is %s, not %s", instanceName, strings.ToLower(state), strings.ToLower(wantState))
+			if state == "" {
+				err = notFoundError("Instance %s not found", instanceName)
+			}
+			auditRecord.finish(err)
+			return "", "", 0, "", 0, "", nil, err
+		}
+		commands = [][]string{{"lxc-" + action, instanceName}}
 	}
 
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	err := cmd.Run()
-	if err != nil {
-		SendInstanceResultToClient(operationId, instanceName, description, "Failure", 102)
-		UpdateOperation(operationId, "Failure", "500")
-		return "", "Failed to execute command", 500, "", 2, err.Error(), map[string]any{}, err
+	operationId := uuid.NewV4().String()
+	description := charCases(action) + " instance"
+	requestor := requestorFromRequest(r)
+	AddOperation(operationId, "task", OperationPending, instanceResources(instanceName), description, false)
+
+	RunOperation(operationId, func(ctx context.Context) error {
+		beginInstanceChange(instanceName)
+		defer endInstanceChange(instanceName)
+		if pendingDir != "" {
+			defer os.RemoveAll(pendingDir)
+		}
+
+		// A frozen instance doesn't react to a clean shutdown
+		if (action == "stop" || action == "restart") && instanceState(instanceName) == "FROZEN" {
+			commands = append([][]string{{"lxc-unfreeze", instanceName}}, commands...)
+		}
+
+		for _, command := range commands {
+			if err := runLxcCommand(ctx, action, instanceName, command); err != nil {
+				auditRecord.finish(err)
+				return err
+			}
+		}
+		if onSuccess != nil {
+			if err := onSuccess(); err != nil {
+				auditRecord.finish(err)
+				return err
+			}
+		}
+		auditRecord.finish(nil)
+
+		SendLifecycleEvent(instanceStateLifecycle[action], "/1.0/instances/"+instanceName, requestor, nil)
+		return nil
+	})
+
+	metadata, _ := GetOperationMetadata(operationId)
+	return "async", "Operation created", 100, "/1.0/operations/" + operationId, 0, "", metadata, nil
+}
+
+// lxcStopCommand returns the lxc-stop command for the options of a stop or restart:
+// force without a timeout kills right away, force with a timeout shuts down
+// cleanly and kills once the timeout passed, a timeout without force fails
+// instead of killing, and -1 waits for the shutdown forever. Without options
+// lxc-stop shuts down cleanly and kills after its own default timeout.
+func lxcStopCommand(instanceName string, payload StatePayload) []string {
+	command := []string{"lxc-stop", instanceName}
+	switch {
+	case payload.Force && payload.Timeout <= 0:
+		command = append(command, "-k")
+	case payload.Force:
+		command = append(command, "-t", strconv.Itoa(payload.Timeout))
+	case payload.Timeout > 0:
+		command = append(command, "-t", strconv.Itoa(payload.Timeout), "--nokill")
+	case payload.Timeout == -1:
+		command = append(command, "-t", "-1")
 	}
+	return command
+}
 
-	metadata := map[string]any{
-		"id":          operationId,
-		"class":       "task",
-		"description": description,
-		"created_at":  time.Now().UTC().Format(time.RFC3339),
-		"updated_at":  time.Now().UTC().Format(time.RFC3339),
-		"status":      "Running",
-		"status_code": 103,
-		"resources": map[string]any{
-			"instances": []string{"/1.0/instances/" + instanceName},
-		},
-		"may_cancel": false,
-		"err":        "",
-		"location":   "none",
+// actionError explains why the lxc command of an action failed, with the end of
+// its stderr and the errors it logged to the lxc log after logOffset, instead
+// of just its exit status.
+func actionError(action, instanceName string, err error, stderr string, logOffset int64) error {
+	details := lastLines(stderr, 3)
+	if action == "start" || action == "restart" {
+		for _, line := range lxcLogErrors(instanceName, logOffset, 3) {
+			if !slices.Contains(details, line) {
+				details = append(details, line)
+			}
+		}
 	}
-	UpdateOperation(operationId, "Success", "")
-	SendInstanceResultToClient(operationId, instanceName, description, "Success", 200)
 
-	return "async", "Operation created", 100, "/1.0/operations/" + operationId, 0, "", metadata, nil
+	message := fmt.Sprintf("Failed to %s instance %s: %v", action, instanceName, err)
+	if len(details) > 0 {
+		message += "\n" + strings.Join(details, "\n")
+	}
+	return errors.New(message)
 }
 
 func putInstanceExecAction(instanceName string, r *http.Request, isConsole bool) (string, string, int, string, int, string, any, error) {
@@ -235,39 +396,80 @@ func putInstanceExecAction(instanceName string, r *http.Request, isConsole bool)
 	maps.Copy(finalEnv, defaultExecEnv)
 	maps.Copy(finalEnv, payload.Environment)
 
-	AddOperation(operationId, "websocket", "Operation created", instanceName, "Executing command", isConsole)
-	AddFds(operationId, fdsData, fdsControl, payload.Command, finalEnv, payload.User, payload.Group)
-
-	metadata := map[string]any{
-		"id":          operationId,
-		"class":       "websocket",
-		"description": "Executing command",
-		"created_at":  time.Now().UTC().Format(time.RFC3339),
-		"updated_at":  time.Now().UTC().Format(time.RFC3339),
-		"status":      "Running",
-		"status_code": 103,
-		"resources": map[string]any{
-			"instances": []string{"/1.0/instances/" + instanceName},
-		},
-		"may_cancel": false,
-		"err":        "",
-		"location":   "none",
-		"metadata": MetadataInMetadata{
+	interactive := isConsole || payload.Interactive == nil || *payload.Interactive
+	if !isConsole && len(payload.Command) == 0 {
+		return "", "", 0, "", 0, "", nil, badRequestError("Missing command")
+	}
+	fds := &Fds{
+		Data:         fdsData,
+		Control:      fdsControl,
+		Interactive:  interactive,
+		RecordOutput: payload.RecordOutput,
+		Command:      payload.Command,
+		Environment:  finalEnv,
+		User:         payload.User,
+		Group:        payload.Group,
+		Cwd:          payload.Cwd,
+		Width:        payload.Width,
+		Height:       payload.Height,
+		Requestor:    requestorFromRequest(r),
+	}
+	fdsMetadata := map[string]string{
+		"0":       fdsData,
+		"control": fdsControl,
+	}
+	if !interactive {
+		fds.Stdout, _ = generateFds(128)
+		fds.Stderr, _ = generateFds(128)
+		fdsMetadata["1"] = fds.Stdout
+		fdsMetadata["2"] = fds.Stderr
+	}
+
+	lifecycleAction := lifecycleInstanceExec
+	if isConsole {
+		lifecycleAction = lifecycleInstanceConsole
+	}
+
+	// Without websockets the command runs right away, with its output recorded or discarded
+	if !interactive && !payload.WaitForWebsocket {
+		AddOperation(operationId, "task", OperationPending, instanceResources(instanceName), "Executing command", false)
+		SetOperationMetadata(operationId, MetadataInMetadata{
 			Command:     payload.Command,
 			Environment: finalEnv,
-			Fds: map[string]string{
-				"0":       fdsData,
-				"control": fdsControl,
-			},
-			Interactive: true,
-		},
+			Fds:         map[string]string{},
+			Interactive: false,
+		})
+		RunOperation(operationId, func(ctx context.Context) error {
+			return runExecDetached(ctx, operationId, instanceName, fds)
+		})
+		SendLifecycleEvent(lifecycleAction, "/1.0/instances/"+instanceName, requestorFromRequest(r), map[string]any{"command": payload.Command})
+
+		metadata, _ := GetOperationMetadata(operationId)
+		return "async", "Operation created", 100, "/1.0/operations/" + operationId, 0, "", metadata, nil
 	}
-	UpdateOperation(operationId, "Success", "")
-	SendInstanceAttachSessionCreatingResultToClient(operationId, instanceName, "Executing command", "Pending", 105, payload.Command, finalEnv)
-	SendInstanceAttachSessionCreatingResultToClient(operationId, instanceName, "Executing command", "Running", 103, payload.Command, finalEnv)
-	UpdateOperation(operationId, "Running", "")
-	SendInstanceAttachSessionCreatedResultToClient(instanceName)
 
+	AddOperation(operationId, "websocket", OperationPending, instanceResources(instanceName), "Executing command", isConsole)
+	AddFds(operationId, fds)
+	SetOperationMetadata(operationId, MetadataInMetadata{
+		Command:     payload.Command,
+		Environment: finalEnv,
+		Fds:         fdsMetadata,
+		Interactive: interactive,
+	})
+
+	// Cancelling kills the session, or stops it from being started
+	SetOperationCancel(operationId, func() {
+		DeleteFds(operationId)
+		closeSession(operationId)
+	})
+
+	// The operation runs until the websockets are closed
+	pending, _ := GetOperationMetadata(operationId)
+	sendOperationEvent(pending)
+	UpdateOperation(operationId, OperationRunning, "")
+	SendLifecycleEvent(lifecycleAction, "/1.0/instances/"+instanceName, requestorFromRequest(r), map[string]any{"command": payload.Command})
+
+	metadata, _ := GetOperationMetadata(operationId)
 	return "async", "Operation created", 100, "/1.0/operations/" + operationId, 0, "", metadata, nil
 }
 
@@ -329,7 +531,7 @@ func getInstanceInfo(instanceName string) (any, error) {
 			Project:      "default",
 			Architecture: nil,
 			Ephemeral:    false,
-			Stateful:     false,
+			Stateful:     hasSavedState(name),
 			Profiles:     []string{"default"},
 			Config: InstanceConfig{
 				ImageArchitecture: nil,
@@ -368,6 +570,9 @@ func getInstanceInfo(instanceName string) (any, error) {
 	}
 
 	if instanceName != "" {
+		if metadata.Name == "" {
+			return nil, notFoundError("Instance not found")
+		}
 		return metadata, nil
 	} else {
 		return instances, nil
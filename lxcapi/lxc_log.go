@@ -0,0 +1,98 @@
+package lxcapi
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Query parameters and headers that must never end up in a log
+var redactedParams = []string{"secret", "token", "password"}
+
+// statusRecorder keeps the status code and size of a response for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.size += n
+	return n, err
+}
+
+// Hijack is needed for the websocket upgrades.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// LogMiddleware writes one access log record per request. Websocket requests
+// are logged when the connection is closed.
+func LogMiddleware(logger *slog.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		client, protocol := ClientIdentity(r)
+		logger.Info("Request",
+			"method", r.Method,
+			"path", redactURL(r.URL),
+			"status", recorder.status,
+			"size", recorder.size,
+			"duration", time.Since(start),
+			"client", client,
+			"protocol", protocol,
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// redactURL returns the path and query of u with secrets replaced.
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, param := range redactedParams {
+		if query.Has(param) {
+			query.Set(param, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI()
+	}
+	return u.Path + "?" + query.Encode()
+}
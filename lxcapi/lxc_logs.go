@@ -0,0 +1,219 @@
+package lxcapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Each instance gets its own directory of log files below logsDir.
+var logsDir = "/var/log/lxc-ui-api"
+
+// SetLogsDir sets the directory the instance log directories are kept in.
+func SetLogsDir(dir string) {
+	logsDir = dir
+}
+
+// instanceLogDir returns the log directory of an instance, or a sub directory
+// of it, and creates it if needed.
+func instanceLogDir(instanceName string, sub ...string) (string, error) {
+	if err := validInstanceName(instanceName); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(append([]string{logsDir, instanceName}, sub...)...)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", fmt.Errorf("Unable to create log directory: %v", err)
+	}
+	return dir, nil
+}
+
+// lxcStartCommand returns the lxc-start command for an instance. The lxc log
+// and the console output go to lxc.log and console.log in its log directory.
+func lxcStartCommand(instanceName string) []string {
+	command := []string{"lxc-start", instanceName}
+	dir, err := instanceLogDir(instanceName)
+	if err != nil {
+		slog.Warn("Starting instance without log files", "instance", instanceName, "err", err)
+		return command
+	}
+	return append(command,
+		"--logfile="+filepath.Join(dir, "lxc.log"),
+		"--console-log="+filepath.Join(dir, "console.log"))
+}
+
+// isLogFileName tells whether name is a plain file name, without any path.
+func isLogFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && filepath.Base(name) == name
+}
+
+// instanceLogsHandler serves the log files of an instance:
+// GET /1.0/instances/{name}/logs lists lxc.log, console.log and the like,
+// GET and DELETE /1.0/instances/{name}/logs/{file},
+// GET /1.0/instances/{name}/logs/exec-output lists the recorded exec output,
+// GET and DELETE /1.0/instances/{name}/logs/exec-output/{file}.
+func instanceLogsHandler(w http.ResponseWriter, r *http.Request, instanceName string, path []string) {
+	var sub []string
+	if len(path) > 0 && path[0] == "exec-output" {
+		sub, path = path[:1], path[1:]
+	}
+	if len(path) > 0 && path[len(path)-1] == "" {
+		path = path[:len(path)-1]
+	}
+	if len(path) > 1 {
+		notFound(w, "Not found")
+		return
+	}
+
+	dir, err := instanceLogDir(instanceName, sub...)
+	if err != nil {
+		smartError(w, err)
+		return
+	}
+	url := strings.Join(append([]string{"/1.0/instances", instanceName, "logs"}, sub...), "/")
+
+	if len(path) == 0 {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w)
+			return
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			smartError(w, fmt.Errorf("Unable to list logs: %v", err))
+			return
+		}
+		files := []string{}
+		for _, entry := range entries {
+			if entry.Type().IsRegular() {
+				files = append(files, url+"/"+entry.Name())
+			}
+		}
+		json.NewEncoder(w).Encode(GeneralResponse{
+			Type:       "sync",
+			Status:     "Success",
+			StatusCode: 200,
+			Metadata:   files,
+		})
+		return
+	}
+
+	name := path[0]
+	if !isLogFileName(name) {
+		badRequest(w, fmt.Errorf("Bad file name %q", name))
+		return
+	}
+	file := filepath.Join(dir, name)
+
+	switch r.Method {
+	case http.MethodGet:
+		logFile, err := os.Open(file)
+		if os.IsNotExist(err) && len(sub) == 0 && (name == "lxc.log" || name == "console.log") {
+			// Not started through the API yet, there is nothing to show
+			w.Header().Set("Content-Type", "application/octet-stream")
+			return
+		} else if err != nil {
+			notFound(w, "Log file not found")
+			return
+		}
+		defer logFile.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, logFile)
+	case http.MethodDelete:
+		// lxc-start keeps writing to lxc.log, like LXD only other logs may go
+		if len(sub) == 0 && (name == "lxc.log" || !strings.HasSuffix(name, ".log")) {
+			badRequest(w, fmt.Errorf("Only log files other than lxc.log may be deleted"))
+			return
+		}
+		if err := os.Remove(file); err != nil {
+			notFound(w, "Log file not found")
+			return
+		}
+		Audit(r, "instance-log-delete", url+"/"+name, nil)
+		json.NewEncoder(w).Encode(GeneralResponse{
+			Type:       "sync",
+			Status:     "Success",
+			StatusCode: 200,
+			Metadata:   map[string]any{},
+		})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// How much of the end of lxc.log is searched for errors
+const lxcLogTailSize = 16 << 10
+
+// lxcLogSize returns the size of the lxc log of an instance, 0 if there is none.
+// lxc-start appends to the same lxc.log on every start, so this is where the
+// lines of the next run begin.
+func lxcLogSize(instanceName string) int64 {
+	dir, err := instanceLogDir(instanceName)
+	if err != nil {
+		return 0
+	}
+	info, err := os.Stat(filepath.Join(dir, "lxc.log"))
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// lxcLogErrors returns the last n ERROR and FATAL lines written to the lxc log
+// of an instance after offset, so earlier runs aren't taken for the cause.
+func lxcLogErrors(instanceName string, offset int64, n int) []string {
+	dir, err := instanceLogDir(instanceName)
+	if err != nil {
+		return nil
+	}
+	logFile, err := os.Open(filepath.Join(dir, "lxc.log"))
+	if err != nil {
+		return nil
+	}
+	defer logFile.Close()
+
+	info, err := logFile.Stat()
+	if err != nil {
+		return nil
+	}
+	if info.Size() < offset {
+		// Truncated in the meantime, everything in it is new
+		offset = 0
+	}
+	offset = max(offset, info.Size()-lxcLogTailSize)
+	if _, err := logFile.Seek(offset, io.SeekStart); err != nil {
+		return nil
+	}
+	tail, err := io.ReadAll(logFile)
+	if err != nil {
+		return nil
+	}
+
+	var errorLines []string
+	for _, line := range strings.Split(string(tail), "\n") {
+		if strings.Contains(line, " ERROR ") || strings.Contains(line, " FATAL ") {
+			errorLines = append(errorLines, strings.TrimSpace(line))
+		}
+	}
+	if len(errorLines) > n {
+		errorLines = errorLines[len(errorLines)-n:]
+	}
+	return errorLines
+}
+
+// lastLines returns the last n non-empty lines of text.
+func lastLines(text string, n int) []string {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
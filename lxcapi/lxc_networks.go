@@ -70,50 +70,53 @@ type GeneralResponse struct {
 }
 
 func NetworksHandler(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	fmt.Println("Request Method:", r.Method, "|", "Request API:", path)
 	w.Header().Set("Content-Type", "application/json")
-	parts := strings.Split(path, "/")
-	var networkName, networkAction string
 	var networkData any
-	var err error
-	if len(parts) == 4 {
-		networkName = parts[3]
-	} else if len(parts) >= 4 {
-		networkName = parts[3]
-		networkAction = parts[4]
+	if !IsTrusted(r) {
+		forbidden(w)
+		return
 	}
 
-	if IsTrusted(r) {
-		if networkName == "" && networkAction == "" {
-			networkData, err = getNetworkInterfaces()
-		} else if networkName != "" && networkAction == "forwards" {
-			networkData = []string{}
-		} else if networkName != "" && networkAction == "state" {
-			networkData, err = getNetworkInterfaceAction(networkName)
-		} else {
-			networkData, err = getNetworkInterfaceInfo(networkName)
-		}
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error retrieving network interfaces: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		response := GeneralResponse{
-			Type:       "sync",
-			Status:     "Success",
-			StatusCode: 200,
-			Operation:  "",
-			ErrorCode:  0,
-			Error:      "",
-			Metadata:   networkData,
-		}
+	networkName, networkAction, err := parseNetworkPath(r.URL.Path)
+	if err != nil {
+		smartError(w, err)
+		return
+	}
+	// Networks are read-only
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
 
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
-		}
+	if networkName == "" && networkAction == "" {
+		networkData, err = getNetworkInterfaces()
+	} else if networkName != "" && networkAction == "forwards" {
+		networkData = []string{}
+	} else if networkName != "" && networkAction == "state" {
+		networkData, err = getNetworkInterfaceAction(networkName)
+	} else if networkAction == "" {
+		networkData, err = getNetworkInterfaceInfo(networkName)
 	} else {
-		http.Error(w, "TLS certificate missing", http.StatusUnauthorized)
+		notFound(w, "Not found")
+		return
+	}
+	if err != nil {
+		smartError(w, err)
+		return
+	}
+
+	response := GeneralResponse{
+		Type:       "sync",
+		Status:     "Success",
+		StatusCode: 200,
+		Operation:  "",
+		ErrorCode:  0,
+		Error:      "",
+		Metadata:   networkData,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, "Error encoding JSON", http.StatusInternalServerError)
 	}
 }
 
@@ -215,7 +218,7 @@ func getNetworkInterfaceInfo(networkName string) (any, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("network interface not found: %s", networkName)
+	return nil, notFoundError("Network not found")
 }
 
 func getNetworkInterfaceAction(networkName string) (any, error) {
@@ -232,7 +235,7 @@ func getNetworkInterfaceAction(networkName string) (any, error) {
 		}
 	}
 	if iface.Name == "" {
-		return nil, fmt.Errorf("network interface not found: %s", networkName)
+		return nil, notFoundError("Network not found")
 	}
 
 	// Mac address
@@ -4,85 +4,119 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
-// OperationsHandler handles the synchronization request. It processes the HTTP request
-// and sends the appropriate response back to the client.
+// OperationsHandler lists the operations grouped by status.
+// GET /1.0/operations?recursion=0|1&project=&all-projects=
 func OperationsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Println("Request Method:", r.Method, "|", "Request API:", r.URL.Path)
 
-	//recursion := r.URL.Query().Get("recursion")
-	//allProjects := r.URL.Query().Get("all-projects")
+	if !IsTrusted(r) {
+		forbidden(w)
+		return
+	}
 
-	if IsTrusted(r) {
+	recursion := r.URL.Query().Get("recursion")
+	allProjects := r.URL.Query().Get("all-projects") == "true"
+	project := r.URL.Query().Get("project")
 
-		// if all-projects is "true", List all.  // Not im
-		operationsList, err := ListOperations()
-		if err != nil {
-			response := map[string]any{
-				"type":        "sync",
-				"status":      "Seccess",
-				"status_code": 200,
-				"operation":   "",
-				"error_code":  0,
-				"error":       err.Error(),
-				"metadata":    map[string]any{},
-			}
-			json.NewEncoder(w).Encode(response)
-			return
+	// Every operation belongs to the default project
+	metadataList := []OperationMetadata{}
+	if allProjects || project == "" || project == "default" {
+		metadataList = ListOperationsMetadata()
+	}
+
+	grouped := map[string][]any{}
+	for _, operation := range metadataList {
+		key := strings.ToLower(operation.Status)
+		if recursion == "1" {
+			grouped[key] = append(grouped[key], operation)
+		} else {
+			grouped[key] = append(grouped[key], "/1.0/operations/"+operation.ID)
 		}
+	}
 
-		successMetadata := []map[string]any{}
-		runningMetadata := []map[string]any{}
-		failureMetadata := []map[string]any{}
+	response := GeneralResponse{
+		Type:       "sync",
+		Status:     "Success",
+		StatusCode: 200,
+		Operation:  "",
+		ErrorCode:  0,
+		Error:      "",
+		Metadata:   grouped,
+	}
+	json.NewEncoder(w).Encode(response)
+}
 
-		for _, operation := range operationsList {
-			operationData := map[string]any{
-				"id":          operation.ID,
-				"class":       operation.Class,
-				"description": operation.Description,
-				"created_at":  operation.CreatedAt.Format(time.RFC3339),
-				"updated_at":  operation.UpdatedAt.Format(time.RFC3339),
-				"status":      operation.Status,
-				"status_code": 200,
-				"metadata":    nil,
-				"may_cancel":  false,
-				"err":         operation.Err,
-				"location":    "none",
-				"resources": map[string]any{
-					"instances": []string{"/1.0/instances/" + operation.Instances},
-				},
-			}
+// OperationHandler serves a single operation:
+// GET and DELETE /1.0/operations/{id}, GET /1.0/operations/{id}/wait?timeout=
+// and the websockets of /1.0/operations/{id}/websocket.
+func OperationHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	var operationID, operationAction string
+	if len(parts) == 4 {
+		operationID = parts[3]
+	} else if len(parts) >= 4 {
+		operationID = parts[3]
+		operationAction = parts[4]
+	}
+
+	// The websocket secret is checked by the terminal handler itself
+	if operationAction == "websocket" {
+		HandleOperationsWebSocketTerminal(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !IsTrusted(r) {
+		forbidden(w)
+		return
+	}
 
-			switch operation.Status {
-			case "Success":
-				successMetadata = append(successMetadata, operationData)
-			case "Running":
-				runningMetadata = append(runningMetadata, operationData)
-			case "Failure":
-				failureMetadata = append(failureMetadata, operationData)
+	var metadata any
+	var err error
+	if operationAction == "" && r.Method == http.MethodGet {
+		metadata, err = GetOperationMetadata(operationID)
+	} else if operationAction == "" && r.Method == http.MethodDelete {
+		if _, err = GetOperation(operationID); err == nil {
+			if err := CancelOperation(operationID); err != nil {
+				writeError(w, http.StatusForbidden, err.Error())
+				return
 			}
+			Audit(r, "operation-cancel", "/1.0/operations/"+operationID, nil)
+			metadata = map[string]any{}
 		}
-
-		response := map[string]any{
-			"type":        "sync",
-			"status":      "Success",
-			"status_code": 200,
-			"operation":   "",
-			"error_code":  0,
-			"error":       "",
-			"metadata": map[string]any{
-				"success": successMetadata,
-				"running": runningMetadata,
-				"failure": failureMetadata,
-			},
+	} else if operationAction == "wait" && r.Method == http.MethodGet {
+		timeout := -1.0
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			timeout, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				badRequest(w, fmt.Errorf("Bad timeout: %v", err))
+				return
+			}
 		}
-		json.NewEncoder(w).Encode(response)
+		metadata, err = WaitOperation(operationID, time.Duration(timeout*float64(time.Second)))
+	} else {
+		notFound(w, "Not found")
+		return
+	}
+
+	if err != nil {
+		notFound(w, err.Error())
 		return
 	}
 
-	response := map[string]any{}
+	response := GeneralResponse{
+		Type:       "sync",
+		Status:     "Success",
+		StatusCode: 200,
+		Operation:  "",
+		ErrorCode:  0,
+		Error:      "",
+		Metadata:   metadata,
+	}
 	json.NewEncoder(w).Encode(response)
 }
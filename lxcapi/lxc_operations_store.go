@@ -0,0 +1,177 @@
+package lxcapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Where the operation history is kept across restarts, empty keeps it in memory only
+var operationStorePath string
+var muStore sync.Mutex
+
+// SetupOperationStore loads the operations saved by a previous run from path
+// and saves them there from now on. Operations that were still running when
+// the server went down are marked as failed.
+func SetupOperationStore(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Unable to read operation store %s: %v", path, err)
+	}
+
+	var stored []*Operation
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return fmt.Errorf("Bad operation store %s: %v", path, err)
+		}
+	}
+
+	mu.Lock()
+	for _, operation := range stored {
+		if !operation.Status.isFinal() {
+			operation.Status = OperationFailure
+			operation.Err = "Server was restarted"
+			operation.UpdatedAt = time.Now()
+		}
+		operation.changed = make(chan struct{})
+		Operations[operation.ID] = operation
+	}
+	mu.Unlock()
+
+	operationStorePath = path
+	writeOperationStore()
+	go storeWriter()
+	return nil
+}
+
+// Set when the operations changed since the store was last written. A single
+// writer goroutine writes them, so a write never replaces a newer one and
+// changes coming in while it writes are saved together.
+var storeDirty = make(chan struct{}, 1)
+
+// saveOperations asks for the operations to be written to the store.
+func saveOperations() {
+	if operationStorePath == "" {
+		return
+	}
+	select {
+	case storeDirty <- struct{}{}:
+	default:
+	}
+}
+
+func storeWriter() {
+	for range storeDirty {
+		writeOperationStore()
+	}
+}
+
+// FlushOperationStore writes the operations to the store right away, on shutdown.
+func FlushOperationStore() {
+	if operationStorePath != "" {
+		writeOperationStore()
+	}
+}
+
+// writeOperationStore writes all operations to the store. The websocket
+// secrets and the exec environment, which often holds secrets of its own,
+// are left out.
+func writeOperationStore() {
+	// The operations are read under muStore too, so the last write always has
+	// the newest state
+	muStore.Lock()
+	defer muStore.Unlock()
+
+	mu.Lock()
+	stored := make([]Operation, 0, len(Operations))
+	for _, operation := range Operations {
+		storedOperation := *operation
+		if execMetadata, ok := storedOperation.Metadata.(MetadataInMetadata); ok {
+			execMetadata.Fds = nil
+			execMetadata.Environment = nil
+			storedOperation.Metadata = execMetadata
+		}
+		stored = append(stored, storedOperation)
+	}
+	mu.Unlock()
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		slog.Error("Unable to marshal operations", "err", err)
+		return
+	}
+
+	temp := operationStorePath + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		slog.Error("Unable to save operations", "path", operationStorePath, "err", err)
+		return
+	}
+	if err := os.Rename(temp, operationStorePath); err != nil {
+		slog.Error("Unable to save operations", "path", operationStorePath, "err", err)
+	}
+}
+
+// CollectOperations removes finished operations older than retention and the
+// websocket secrets nobody connected to within websocketTimeout, until ctx is done.
+func CollectOperations(ctx context.Context, retention, websocketTimeout time.Duration) {
+	interval := min(retention, websocketTimeout, time.Minute)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		collectFdses(websocketTimeout)
+		collectOperations(retention)
+	}
+}
+
+func collectOperations(retention time.Duration) {
+	expired := time.Now().Add(-retention)
+	removed := 0
+
+	mu.Lock()
+	for id, operation := range Operations {
+		if operation.Status.isFinal() && operation.UpdatedAt.Before(expired) {
+			delete(Operations, id)
+			removed++
+		}
+	}
+	mu.Unlock()
+
+	if removed > 0 {
+		slog.Debug("Removed expired operations", "count", removed)
+		saveOperations()
+	}
+}
+
+func collectFdses(websocketTimeout time.Duration) {
+	expired := time.Now().Add(-websocketTimeout)
+	fdses, _ := ListFdses()
+
+	for _, fds := range fdses {
+		muSessions.Lock()
+		_, connected := Sessions[fds.ID]
+		muSessions.Unlock()
+		if connected {
+			continue
+		}
+
+		metadata, err := GetOperationMetadata(fds.ID)
+		if err == nil && OperationStatus(metadata.StatusCode).isFinal() {
+			DeleteFds(fds.ID)
+			continue
+		}
+		if fds.CreatedAt.Before(expired) {
+			DeleteFds(fds.ID)
+			UpdateOperation(fds.ID, OperationFailure, "Timed out waiting for websockets")
+		}
+	}
+}
@@ -1,38 +1,151 @@
 package lxcapi
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OperationStatus is the status of an operation, its value is the LXD status code.
+type OperationStatus int
+
+const (
+	OperationPending   OperationStatus = 105
+	OperationRunning   OperationStatus = 103
+	OperationSuccess   OperationStatus = 200
+	OperationFailure   OperationStatus = 400
+	OperationCancelled OperationStatus = 401
 )
 
+var operationStatusNames = map[OperationStatus]string{
+	OperationPending:   "Pending",
+	OperationRunning:   "Running",
+	OperationSuccess:   "Success",
+	OperationFailure:   "Failure",
+	OperationCancelled: "Cancelled",
+}
+
+func (status OperationStatus) String() string {
+	return operationStatusNames[status]
+}
+
+// Code returns the LXD status code.
+func (status OperationStatus) Code() int {
+	return int(status)
+}
+
+// isFinal tells whether an operation with this status is done.
+func (status OperationStatus) isFinal() bool {
+	return status == OperationSuccess || status == OperationFailure || status == OperationCancelled
+}
+
+func (status OperationStatus) MarshalText() ([]byte, error) {
+	return []byte(status.String()), nil
+}
+
+func (status *OperationStatus) UnmarshalText(text []byte) error {
+	for value, name := range operationStatusNames {
+		if name == string(text) {
+			*status = value
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown operation status %q", text)
+}
+
 type Operation struct {
-	ID          string    `json:"id"`
-	Class       string    `json:"class"`
-	Status      string    `json:"status"`
-	Instances   string    `json:"instances"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
-	Err         string    `json:"err"`
+	ID          string              `json:"id"`
+	Class       string              `json:"class"`
+	Status      OperationStatus     `json:"status"`
+	Resources   map[string][]string `json:"resources"`
+	Description string              `json:"description"`
+	CreatedAt   time.Time           `json:"created_at"`
+	UpdatedAt   time.Time           `json:"updated_at"`
+	Metadata    any                 `json:"metadata"`
+	Err         string              `json:"err"`
 	IsConsole   bool
+	// Stops the work of the operation, nil if it can't be cancelled
+	cancel func()
+	// Closed and replaced whenever the status changes
+	changed chan struct{}
+}
+
+// instanceResources returns the resources of an operation on a single instance.
+func instanceResources(instanceName string) map[string][]string {
+	return map[string][]string{
+		"instances": {"/1.0/instances/" + instanceName},
+	}
+}
+
+// instanceName returns the name of the first instance the operation is about.
+func (operation *Operation) instanceName() string {
+	instances := operation.Resources["instances"]
+	if len(instances) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(instances[0], "/1.0/instances/")
 }
 
 type Fds struct {
-	ID          string            `json:"id"`
-	Data        string            `json:"0"`
-	Control     string            `json:"control"`
-	Command     []string          `json:"command"`
-	Environment map[string]string `json:"environment"`
-	User        int               `json:"user"`
-	Group       int               `json:"group"`
+	ID      string `json:"id"`
+	Data    string `json:"0"`
+	Stdout  string `json:"1,omitempty"`
+	Stderr  string `json:"2,omitempty"`
+	Control string `json:"control"`
+	// Interactive execs use a single pty on the 0 websocket,
+	// the others get separate stdin/stdout/stderr websockets.
+	Interactive  bool              `json:"interactive"`
+	RecordOutput bool              `json:"record-output"`
+	Command      []string          `json:"command"`
+	Environment  map[string]string `json:"environment"`
+	User         int               `json:"user"`
+	Group        int               `json:"group"`
+	Cwd          string            `json:"cwd"`
+	// Initial terminal size of interactive sessions
+	Width     int             `json:"width"`
+	Height    int             `json:"height"`
+	Requestor *EventRequestor `json:"-"`
+	CreatedAt time.Time       `json:"-"`
+}
+
+// streamFd returns the fd a non-interactive websocket secret belongs to.
+func (fds *Fds) streamFd(secret string) string {
+	switch secret {
+	case fds.Data:
+		return "0"
+	case fds.Stdout:
+		return "1"
+	case fds.Stderr:
+		return "2"
+	}
+	return ""
+}
+
+// Session is a running exec or console attached to its websockets.
+// Ptmx is nil for non-interactive execs.
+type Session struct {
+	ID    string
+	Ptmx  *os.File
+	Cmd   *exec.Cmd
+	Conns []*websocket.Conn
+	// The pty of a console belongs to the instance console and is shared
+	// with the other viewers, closing the session leaves it open
+	SharedPtmx bool
 }
 
 var Operations = make(map[string]*Operation)
 var Fdses = make(map[string]*Fds)
-var mu, muFds sync.Mutex
+var Sessions = make(map[string]*Session)
+var mu, muFds, muSessions sync.Mutex
 
-func AddOperation(operationID, operationClass, status, instanceName, description string, isConsole bool) {
+func AddOperation(operationID, operationClass string, status OperationStatus, resources map[string][]string, description string, isConsole bool) {
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -40,12 +153,13 @@ func AddOperation(operationID, operationClass, status, instanceName, description
 		ID:          operationID,
 		Class:       operationClass,
 		Status:      status,
+		Resources:   resources,
 		CreatedAt:   time.Now(),
 		UpdatedAt:   time.Now(),
 		Err:         "",
-		Instances:   instanceName,
 		Description: description,
 		IsConsole:   isConsole,
+		changed:     make(chan struct{}),
 	}
 
 	Operations[operationID] = operation
@@ -62,19 +176,185 @@ func DeleteOperation(operationID string) error {
 	return fmt.Errorf("operation with ID %s not found", operationID)
 }
 
-func UpdateOperation(operationID, status, err string) error {
+// UpdateOperation changes the status of an operation and sends it to the
+// operation event subscribers. Once an operation is done its status is kept,
+// so a cancelled operation doesn't turn into a failed one.
+func UpdateOperation(operationID string, status OperationStatus, err string) error {
+	mu.Lock()
+	operation, exists := Operations[operationID]
+	if !exists {
+		mu.Unlock()
+		return fmt.Errorf("operation with ID %s not found", operationID)
+	}
+	if operation.Status.isFinal() {
+		mu.Unlock()
+		return nil
+	}
+	operation.Status = status
+	operation.Err = err
+	operation.UpdatedAt = time.Now()
+	close(operation.changed)
+	operation.changed = make(chan struct{})
+	metadata := operation.toMetadata()
+	mu.Unlock()
+
+	saveOperations()
+	return sendOperationEvent(metadata)
+}
+
+// SetOperationCancel sets how a running operation is cancelled.
+func SetOperationCancel(operationID string, cancel func()) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if operation, exists := Operations[operationID]; exists {
+		operation.cancel = cancel
+		return nil
+	}
+	return fmt.Errorf("operation with ID %s not found", operationID)
+}
+
+// CancelOperation stops a running operation and marks it as cancelled.
+func CancelOperation(operationID string) error {
+	return cancelOperation(operationID, "Operation cancelled")
+}
+
+// cancelOperation marks an operation as cancelled with reason and stops it.
+func cancelOperation(operationID, reason string) error {
+	mu.Lock()
+	operation, exists := Operations[operationID]
+	if !exists {
+		mu.Unlock()
+		return fmt.Errorf("operation with ID %s not found", operationID)
+	}
+	cancel := operation.cancel
+	if cancel == nil || operation.Status.isFinal() {
+		mu.Unlock()
+		return fmt.Errorf("operation with ID %s can't be cancelled", operationID)
+	}
+	mu.Unlock()
+
+	UpdateOperation(operationID, OperationCancelled, reason)
+	cancel()
+	return nil
+}
+
+// WaitOperation blocks until the operation is done or the timeout passes.
+// A negative timeout waits forever.
+func WaitOperation(operationID string, timeout time.Duration) (OperationMetadata, error) {
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		mu.Lock()
+		operation, exists := Operations[operationID]
+		if !exists {
+			mu.Unlock()
+			return OperationMetadata{}, fmt.Errorf("operation with ID %s not found", operationID)
+		}
+		metadata := operation.toMetadata()
+		final := operation.Status.isFinal()
+		changed := operation.changed
+		mu.Unlock()
+
+		if final {
+			return metadata, nil
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+			return metadata, nil
+		}
+	}
+}
+
+// operationChanged returns a channel that is closed on the next status change
+// of the operation, or right away if there is no such operation.
+func operationChanged(operationID string) <-chan struct{} {
 	mu.Lock()
 	defer mu.Unlock()
 
 	if operation, exists := Operations[operationID]; exists {
-		operation.Status = status
-		operation.Err = err
+		return operation.changed
+	}
+	closed := make(chan struct{})
+	close(closed)
+	return closed
+}
+
+func SetOperationMetadata(operationID string, metadata any) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if operation, exists := Operations[operationID]; exists {
+		operation.Metadata = metadata
 		operation.UpdatedAt = time.Now()
 		return nil
 	}
 	return fmt.Errorf("operation with ID %s not found", operationID)
 }
 
+// Tasks started by RunOperation that haven't returned yet
+var runningTasks sync.WaitGroup
+
+// RunOperation runs task in the background. The operation goes from Pending
+// to Running and then to Success or Failure with the error of the task.
+// Cancelling the operation cancels the context given to the task.
+func RunOperation(operationID string, task func(ctx context.Context) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	SetOperationCancel(operationID, cancel)
+	if operation, err := GetOperationMetadata(operationID); err == nil {
+		sendOperationEvent(operation)
+	}
+	// Running before returning, so the response to the request says so
+	UpdateOperation(operationID, OperationRunning, "")
+
+	runningTasks.Add(1)
+	go func() {
+		defer runningTasks.Done()
+		defer cancel()
+		if err := task(ctx); err != nil {
+			UpdateOperation(operationID, OperationFailure, err.Error())
+			return
+		}
+		UpdateOperation(operationID, OperationSuccess, "")
+	}()
+}
+
+// GetOperationMetadata returns a consistent copy of the operation for responses.
+func GetOperationMetadata(operationID string) (OperationMetadata, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if operation, exists := Operations[operationID]; exists {
+		return operation.toMetadata(), nil
+	}
+	return OperationMetadata{}, fmt.Errorf("operation with ID %s not found", operationID)
+}
+
+// toMetadata must be called with mu held.
+func (operation *Operation) toMetadata() OperationMetadata {
+	return OperationMetadata{
+		ID:          operation.ID,
+		Class:       operation.Class,
+		Description: operation.Description,
+		CreatedAt:   operation.CreatedAt,
+		UpdatedAt:   operation.UpdatedAt,
+		Status:      operation.Status.String(),
+		StatusCode:  operation.Status.Code(),
+		Resources:   operation.Resources,
+		Metadata:    operation.Metadata,
+		MayCancel:   operation.cancel != nil && !operation.Status.isFinal(),
+		Err:         operation.Err,
+		Location:    "none",
+	}
+}
+
 func GetOperation(operationID string) (*Operation, error) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -89,33 +369,37 @@ func ListOperations() ([]*Operation, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	var operationsList []*Operation
+	operationsList := []*Operation{}
 	for _, operation := range Operations {
 		operationsList = append(operationsList, operation)
 	}
 
-	if len(operationsList) == 0 {
-		return nil, fmt.Errorf("no operations found")
+	return operationsList, nil
+}
+
+// ListOperationsMetadata returns a consistent copy of every operation, oldest first.
+func ListOperationsMetadata() []OperationMetadata {
+	mu.Lock()
+	defer mu.Unlock()
+
+	metadataList := []OperationMetadata{}
+	for _, operation := range Operations {
+		metadataList = append(metadataList, operation.toMetadata())
 	}
+	sort.Slice(metadataList, func(i, j int) bool {
+		return metadataList[i].CreatedAt.Before(metadataList[j].CreatedAt)
+	})
 
-	return operationsList, nil
+	return metadataList
 }
 
 // Fds
-func AddFds(operationID, data, control string, command []string, env map[string]string, u, g int) {
+func AddFds(operationID string, fds *Fds) {
 	muFds.Lock()
 	defer muFds.Unlock()
 
-	fds := &Fds{
-		ID:          operationID,
-		Data:        data,
-		Control:     control,
-		Command:     command,
-		Environment: env,
-		User:        u,
-		Group:       g,
-	}
-
+	fds.ID = operationID
+	fds.CreatedAt = time.Now()
 	Fdses[operationID] = fds
 }
 
@@ -155,3 +439,68 @@ func ListFdses() ([]*Fds, error) {
 
 	return fdsesList, nil
 }
+
+// Sessions
+func AddSession(operationID string, ptmx *os.File, cmd *exec.Cmd, conns ...*websocket.Conn) {
+	muSessions.Lock()
+	defer muSessions.Unlock()
+
+	Sessions[operationID] = &Session{
+		ID:    operationID,
+		Ptmx:  ptmx,
+		Cmd:   cmd,
+		Conns: conns,
+	}
+}
+
+// addConsoleSession adds the session of a console viewer, with the shared
+// pty of the instance console for resizing and signals.
+func addConsoleSession(operationID string, ptmx *os.File, conn *websocket.Conn) {
+	muSessions.Lock()
+	defer muSessions.Unlock()
+
+	Sessions[operationID] = &Session{
+		ID:         operationID,
+		Ptmx:       ptmx,
+		Conns:      []*websocket.Conn{conn},
+		SharedPtmx: true,
+	}
+}
+
+func DeleteSession(operationID string) {
+	muSessions.Lock()
+	defer muSessions.Unlock()
+
+	delete(Sessions, operationID)
+}
+
+// closeSession kills the process of a session and closes its websocket.
+func closeSession(operationID string) {
+	muSessions.Lock()
+	session, exists := Sessions[operationID]
+	muSessions.Unlock()
+	if !exists {
+		return
+	}
+
+	if session.Cmd != nil && session.Cmd.Process != nil {
+		session.Cmd.Process.Kill()
+	}
+	if session.Ptmx != nil && !session.SharedPtmx {
+		session.Ptmx.Close()
+	}
+	for _, conn := range session.Conns {
+		conn.Close()
+	}
+}
+
+func ListSessions() []*Session {
+	muSessions.Lock()
+	defer muSessions.Unlock()
+
+	var sessionsList []*Session
+	for _, session := range Sessions {
+		sessionsList = append(sessionsList, session)
+	}
+	return sessionsList
+}
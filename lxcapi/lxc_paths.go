@@ -0,0 +1,94 @@
+package lxcapi
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Instance names are what LXC accepts as a container name and can use as its
+// hostname. They can't start with a dash, so lxc tools never take one for an
+// option. They never hold a slash, a leading dot or "..", so they are safe in
+// paths, other dots are fine.
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// Network names are Linux interface names, at most 15 bytes long.
+var networkNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,14}$`)
+
+// validInstanceName returns why name can't be the name of an instance, or nil.
+func validInstanceName(name string) error {
+	if !instanceNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return badRequestError("Invalid instance name %q", name)
+	}
+	return nil
+}
+
+// validNetworkName returns why name can't be the name of a network, or nil.
+func validNetworkName(name string) error {
+	if !networkNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return badRequestError("Invalid network name %q", name)
+	}
+	return nil
+}
+
+// splitPath splits a request path below prefix into the name of an object,
+// the action on it and whatever follows. A trailing slash after the prefix
+// or the name is ignored.
+func splitPath(path, prefix string) (name, action string, rest []string, ok bool) {
+	remainder, found := strings.CutPrefix(path, prefix)
+	if !found {
+		return "", "", nil, false
+	}
+	if remainder == "" || remainder == "/" {
+		return "", "", nil, true
+	}
+	if remainder[0] != '/' {
+		return "", "", nil, false
+	}
+
+	parts := strings.Split(remainder[1:], "/")
+	name = parts[0]
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	if len(parts) > 2 {
+		rest = parts[2:]
+	}
+	return name, action, rest, true
+}
+
+// parseInstancePath parses /1.0/instances/{name}/{action}/... into the name
+// of the instance, the action and the rest of the path. The name is empty for
+// the list of instances.
+func parseInstancePath(path string) (name, action string, rest []string, err error) {
+	name, action, rest, ok := splitPath(path, "/1.0/instances")
+	if !ok {
+		return "", "", nil, notFoundError("Not found")
+	}
+	if name == "" && (action != "" || len(rest) > 0) {
+		return "", "", nil, badRequestError("Missing instance name")
+	}
+	if name != "" {
+		if err := validInstanceName(name); err != nil {
+			return "", "", nil, err
+		}
+	}
+	return name, action, rest, nil
+}
+
+// parseNetworkPath parses /1.0/networks/{name}/{action} into the name of the
+// network and the action. The name is empty for the list of networks.
+func parseNetworkPath(path string) (name, action string, err error) {
+	name, action, rest, ok := splitPath(path, "/1.0/networks")
+	if !ok || len(rest) > 1 || (len(rest) == 1 && rest[0] != "") {
+		return "", "", notFoundError("Not found")
+	}
+	if name == "" && action != "" {
+		return "", "", badRequestError("Missing network name")
+	}
+	if name != "" {
+		if err := validNetworkName(name); err != nil {
+			return "", "", err
+		}
+	}
+	return name, action, nil
+}
@@ -0,0 +1,231 @@
+package lxcapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseInstancePath(t *testing.T) {
+	tests := []struct {
+		path   string
+		name   string
+		action string
+		rest   []string
+		fails  bool
+	}{
+		{path: "/1.0/instances"},
+		{path: "/1.0/instances/"},
+		{path: "/1.0/instances/c1", name: "c1"},
+		{path: "/1.0/instances/c1/", name: "c1"},
+		{path: "/1.0/instances/c1/state", name: "c1", action: "state"},
+		{path: "/1.0/instances/web-01.example/exec", name: "web-01.example", action: "exec"},
+		{path: "/1.0/instances/c1/logs/lxc.log", name: "c1", action: "logs", rest: []string{"lxc.log"}},
+		{path: "/1.0/instances/c1/logs/exec-output/", name: "c1", action: "logs", rest: []string{"exec-output", ""}},
+		{path: "/1.0/instances/c1/snapshots/snap0", name: "c1", action: "snapshots", rest: []string{"snap0"}},
+		{path: "/1.0/instancesx", fails: true},
+		{path: "/1.0/networks/c1", fails: true},
+		{path: "/1.0/instances//state", fails: true},
+		{path: "/1.0/instances/-n", fails: true},
+		{path: "/1.0/instances/--rcfile=x/state", fails: true},
+		{path: "/1.0/instances/../state", fails: true},
+		{path: "/1.0/instances/./state", fails: true},
+		{path: "/1.0/instances/c1..c2", fails: true},
+		{path: "/1.0/instances/c1;reboot/state", fails: true},
+		{path: "/1.0/instances/$(id)", fails: true},
+		{path: "/1.0/instances/c 1", fails: true},
+		{path: "/1.0/instances/c1\n", fails: true},
+		{path: "/1.0/instances/" + strings.Repeat("a", 63), name: strings.Repeat("a", 63)},
+		{path: "/1.0/instances/" + strings.Repeat("a", 64), fails: true},
+	}
+
+	for _, test := range tests {
+		name, action, rest, err := parseInstancePath(test.path)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseInstancePath(%q) succeeded, want an error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseInstancePath(%q) failed: %v", test.path, err)
+			continue
+		}
+		if name != test.name || action != test.action || !slices.Equal(rest, test.rest) {
+			t.Errorf("parseInstancePath(%q) = %q, %q, %q, want %q, %q, %q",
+				test.path, name, action, rest, test.name, test.action, test.rest)
+		}
+	}
+}
+
+func TestParseNetworkPath(t *testing.T) {
+	tests := []struct {
+		path   string
+		name   string
+		action string
+		fails  bool
+	}{
+		{path: "/1.0/networks"},
+		{path: "/1.0/networks/"},
+		{path: "/1.0/networks/lxcbr0", name: "lxcbr0"},
+		{path: "/1.0/networks/lxcbr0/", name: "lxcbr0"},
+		{path: "/1.0/networks/eth0.100/state", name: "eth0.100", action: "state"},
+		{path: "/1.0/networks/lxcbr0/state/", name: "lxcbr0", action: "state"},
+		{path: "/1.0/networks/lxcbr0/state/x", fails: true},
+		{path: "/1.0/networksx", fails: true},
+		{path: "/1.0/networks//state", fails: true},
+		{path: "/1.0/networks/../state", fails: true},
+		{path: "/1.0/networks/-lo", fails: true},
+		{path: "/1.0/networks/lo;id", fails: true},
+		{path: "/1.0/networks/abcdefghijklmno", name: "abcdefghijklmno"},
+		{path: "/1.0/networks/abcdefghijklmnop", fails: true},
+	}
+
+	for _, test := range tests {
+		name, action, err := parseNetworkPath(test.path)
+		if test.fails {
+			if err == nil {
+				t.Errorf("parseNetworkPath(%q) succeeded, want an error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseNetworkPath(%q) failed: %v", test.path, err)
+			continue
+		}
+		if name != test.name || action != test.action {
+			t.Errorf("parseNetworkPath(%q) = %q, %q, want %q, %q", test.path, name, action, test.name, test.action)
+		}
+	}
+}
+
+// checkParsedName fails the test if a name accepted by a path parser could be
+// mistaken for an option or a path by the lxc tools.
+func checkParsedName(t *testing.T, path, name string) {
+	if name == "" {
+		return
+	}
+	if strings.HasPrefix(name, "-") || strings.ContainsAny(name, "/\\ \t\r\n\x00;&|$`'\"*?<>()") ||
+		name == "." || name == ".." || strings.Contains(name, "..") {
+		t.Fatalf("unsafe name %q accepted from %q", name, path)
+	}
+}
+
+func FuzzParseInstancePath(f *testing.F) {
+	for _, path := range []string{
+		"/1.0/instances", "/1.0/instances/c1/state", "/1.0/instances/c1/logs/exec-output/x.stdout",
+		"/1.0/instances/../../etc/passwd", "/1.0/instances/-k", "/1.0/instances/c1;id",
+	} {
+		f.Add(path)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		name, action, rest, err := parseInstancePath(path)
+		if err != nil {
+			return
+		}
+		checkParsedName(t, path, name)
+		if name == "" && (action != "" || len(rest) > 0) {
+			t.Fatalf("action %q without an instance in %q", action, path)
+		}
+
+		// The parts are the path again, short of a trailing slash
+		rebuilt := strings.Join(append([]string{"/1.0/instances", name, action}, rest...), "/")
+		if strings.TrimRight(rebuilt, "/") != strings.TrimRight(path, "/") {
+			t.Fatalf("parts of %q make %q", path, rebuilt)
+		}
+	})
+}
+
+func FuzzParseNetworkPath(f *testing.F) {
+	for _, path := range []string{
+		"/1.0/networks", "/1.0/networks/lxcbr0", "/1.0/networks/lxcbr0/state",
+		"/1.0/networks/../state", "/1.0/networks/-x", "/1.0/networks/a/b/c",
+	} {
+		f.Add(path)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		name, action, err := parseNetworkPath(path)
+		if err != nil {
+			return
+		}
+		checkParsedName(t, path, name)
+		if len(name) > 15 {
+			t.Fatalf("name %q from %q is too long for an interface", name, path)
+		}
+		if strings.Contains(action, "/") {
+			t.Fatalf("action %q from %q holds a slash", action, path)
+		}
+	})
+}
+
+func TestValidInstanceName(t *testing.T) {
+	for _, name := range []string{"c1", "C1", "1c", "web_01", "a.b-c"} {
+		if err := validInstanceName(name); err != nil {
+			t.Errorf("validInstanceName(%q) failed: %v", name, err)
+		}
+	}
+	for _, name := range []string{"", ".", "..", "-c1", "_c1", ".c1", "a/b", "a b", "a..b", "é"} {
+		if err := validInstanceName(name); err == nil {
+			t.Errorf("validInstanceName(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestHandlersRejectBadNames(t *testing.T) {
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		path    string
+		trusted bool
+		status  int
+	}{
+		{InstancesHandler, http.MethodGet, "/1.0/instances/-n", true, http.StatusBadRequest},
+		{InstancesHandler, http.MethodPut, "/1.0/instances/c1;reboot/state", true, http.StatusBadRequest},
+		{InstancesHandler, http.MethodGet, "/1.0/instances/../logs/lxc.log", true, http.StatusBadRequest},
+		{InstancesHandler, http.MethodGet, "/1.0/instances//state", true, http.StatusBadRequest},
+		{NetworksHandler, http.MethodGet, "/1.0/networks/-lo", true, http.StatusBadRequest},
+		{NetworksHandler, http.MethodGet, "/1.0/networks/abcdefghijklmnop/state", true, http.StatusBadRequest},
+		{NetworksHandler, http.MethodGet, "/1.0/networks/lo/state/x", true, http.StatusNotFound},
+		// Routes refuse the methods they don't answer to
+		{InstancesHandler, http.MethodDelete, "/1.0/instances", true, http.StatusMethodNotAllowed},
+		{InstancesHandler, http.MethodDelete, "/1.0/instances/c1", true, http.StatusMethodNotAllowed},
+		{InstancesHandler, http.MethodPut, "/1.0/instances/c1", true, http.StatusMethodNotAllowed},
+		{InstancesHandler, http.MethodPatch, "/1.0/instances/c1", true, http.StatusMethodNotAllowed},
+		{InstancesHandler, http.MethodPost, "/1.0/instances/c1/forwards", true, http.StatusMethodNotAllowed},
+		{InstancesHandler, http.MethodPost, "/1.0/instances/c1/state", true, http.StatusMethodNotAllowed},
+		{InstancesHandler, http.MethodGet, "/1.0/instances/c1/exec", true, http.StatusMethodNotAllowed},
+		{InstancesHandler, http.MethodPut, "/1.0/instances/c1/console", true, http.StatusMethodNotAllowed},
+		{NetworksHandler, http.MethodPost, "/1.0/networks", true, http.StatusMethodNotAllowed},
+		{NetworksHandler, http.MethodDelete, "/1.0/networks/lo", true, http.StatusMethodNotAllowed},
+		{NetworksHandler, http.MethodPut, "/1.0/networks/lo", true, http.StatusMethodNotAllowed},
+		{NetworksHandler, http.MethodPatch, "/1.0/networks/lo/state", true, http.StatusMethodNotAllowed},
+		// Untrusted clients learn nothing about names
+		{InstancesHandler, http.MethodGet, "/1.0/instances/-n", false, http.StatusForbidden},
+		{NetworksHandler, http.MethodGet, "/1.0/networks/-lo", false, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "http://lxc"+test.path, strings.NewReader(`{"action":"stop"}`))
+		if test.trusted {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: []byte("client")}}}
+		}
+		w := httptest.NewRecorder()
+		test.handler(w, r)
+
+		var response GeneralResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Errorf("%s %s: bad response %q: %v", test.method, test.path, w.Body.String(), err)
+			continue
+		}
+		if w.Code != test.status || response.Type != "error" || response.ErrorCode != test.status {
+			t.Errorf("%s %s = %d %+v, want a %d error", test.method, test.path, w.Code, response, test.status)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package lxcapi
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 )
 
@@ -10,7 +9,6 @@ import (
 // and sends the appropriate response back to the client.
 func ProjectHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Println("Request Method:", r.Method, "|", "Request API:", r.URL.Path)
 	//recursion := r.URL.Query().Get("recursion")
 
 	if IsTrusted(r) {
@@ -43,6 +41,5 @@ func ProjectHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(response)
 		return
 	}
-	response := map[string]any{}
-	json.NewEncoder(w).Encode(response)
+	forbidden(w)
 }
@@ -2,7 +2,6 @@ package lxcapi
 
 import (
 	"encoding/json"
-	"fmt"
 	"net/http"
 )
 
@@ -10,7 +9,6 @@ import (
 // and sends the appropriate response back to the client.
 func ProjectDefaultHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Println("Request Method:", r.Method, "|", "Request API:", r.URL.Path)
 
 	if IsTrusted(r) {
 		response := map[string]any{
@@ -41,7 +39,5 @@ func ProjectDefaultHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// No auth
-	response := map[string]any{}
-	json.NewEncoder(w).Encode(response)
+	forbidden(w)
 }
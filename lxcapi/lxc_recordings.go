@@ -0,0 +1,252 @@
+package lxcapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecordingHeader is the asciinema v2 header of a recording. Besides the
+// standard fields it has who ran what where, for review.
+type RecordingHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Command   string            `json:"command,omitempty"`
+	Title     string            `json:"title"`
+	Env       map[string]string `json:"env,omitempty"`
+	Operation string            `json:"operation"`
+	Instance  string            `json:"instance"`
+	Client    string            `json:"client"`
+	Protocol  string            `json:"protocol"`
+	Address   string            `json:"address"`
+}
+
+// RecordingInfo describes a recording in the listing of /1.0/admin/recordings.
+type RecordingInfo struct {
+	RecordingHeader
+	Size     int64  `json:"size"`
+	Location string `json:"location"`
+}
+
+// recorder writes the output of a pty session in the asciinema v2 format.
+// All methods do nothing on a nil recorder, so callers don't have to check
+// whether recording is enabled.
+type recorder struct {
+	mu    sync.Mutex
+	file  *os.File
+	start time.Time
+}
+
+// Recordings are kept in recordingsDir, nothing is recorded if it is empty.
+var recordingsDir string
+
+var activeRecordings = make(map[string]*recorder)
+var muRecordings sync.Mutex
+
+// SetupRecordings enables the recording of exec and console sessions into dir.
+func SetupRecordings(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("Unable to create recordings directory %s: %v", dir, err)
+	}
+	recordingsDir = dir
+	return nil
+}
+
+// startRecording starts recording the pty session of an operation.
+// It returns nil if recording is disabled or the recording can't be created.
+func startRecording(operationID, instanceName string, fds *Fds, isConsole bool) *recorder {
+	if recordingsDir == "" {
+		return nil
+	}
+
+	header := RecordingHeader{
+		Version:   2,
+		Width:     fds.Width,
+		Height:    fds.Height,
+		Timestamp: time.Now().Unix(),
+		Title:     "exec " + instanceName,
+		Command:   strings.Join(fds.Command, " "),
+		Env:       map[string]string{"TERM": fds.Environment["TERM"]},
+		Operation: operationID,
+		Instance:  instanceName,
+	}
+	if isConsole {
+		header.Title = "console " + instanceName
+		header.Command = ""
+		header.Env = nil
+	}
+	if header.Width <= 0 || header.Height <= 0 {
+		header.Width, header.Height = 80, 24
+	}
+	if fds.Requestor != nil {
+		header.Client = fds.Requestor.Username
+		header.Protocol = fds.Requestor.Protocol
+		header.Address = fds.Requestor.Address
+	}
+
+	file, err := os.OpenFile(filepath.Join(recordingsDir, operationID+".cast"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		slog.Error("Unable to create recording", "operation", operationID, "err", err)
+		return nil
+	}
+	line, _ := json.Marshal(header)
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		slog.Error("Unable to write recording", "operation", operationID, "err", err)
+		file.Close()
+		return nil
+	}
+
+	rec := &recorder{file: file, start: time.Now()}
+	muRecordings.Lock()
+	activeRecordings[operationID] = rec
+	muRecordings.Unlock()
+	return rec
+}
+
+// activeRecording returns the recorder of a running session, or nil.
+func activeRecording(operationID string) *recorder {
+	muRecordings.Lock()
+	defer muRecordings.Unlock()
+
+	return activeRecordings[operationID]
+}
+
+// stopRecording closes the recording of a session.
+func stopRecording(operationID string) {
+	muRecordings.Lock()
+	rec := activeRecordings[operationID]
+	delete(activeRecordings, operationID)
+	muRecordings.Unlock()
+
+	if rec != nil {
+		rec.mu.Lock()
+		rec.file.Close()
+		rec.mu.Unlock()
+	}
+}
+
+// output records what the session printed.
+func (rec *recorder) output(p []byte) {
+	rec.event("o", string(p))
+}
+
+// resize records a change of the terminal size.
+func (rec *recorder) resize(width, height int) {
+	rec.event("r", fmt.Sprintf("%dx%d", width, height))
+}
+
+func (rec *recorder) event(code, data string) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	elapsed := time.Since(rec.start).Seconds()
+	line, _ := json.Marshal([]any{elapsed, code, data})
+	rec.file.Write(append(line, '\n'))
+}
+
+// listRecordings returns the recordings, newest first.
+func listRecordings() ([]RecordingInfo, error) {
+	recordings := []RecordingInfo{}
+	if recordingsDir == "" {
+		return recordings, nil
+	}
+
+	entries, err := os.ReadDir(recordingsDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), ".cast") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		file, err := os.Open(filepath.Join(recordingsDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var header RecordingHeader
+		line, _ := bufio.NewReader(file).ReadBytes('\n')
+		file.Close()
+		if err := json.Unmarshal(line, &header); err != nil {
+			continue
+		}
+		recordings = append(recordings, RecordingInfo{
+			RecordingHeader: header,
+			Size:            info.Size(),
+			Location:        "/1.0/admin/recordings/" + strings.TrimSuffix(entry.Name(), ".cast"),
+		})
+	}
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].Timestamp > recordings[j].Timestamp
+	})
+
+	return recordings, nil
+}
+
+// RecordingsHandler lists the session recordings on /1.0/admin/recordings
+// and serves a single one as an asciinema file on /1.0/admin/recordings/{id}.
+func RecordingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if !IsTrusted(r) {
+		forbidden(w)
+		return
+	}
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	operationID := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/1.0/admin/recordings"), "/")
+	if operationID == "" {
+		recordings, err := listRecordings()
+		if err != nil {
+			smartError(w, fmt.Errorf("Error reading recordings: %v", err))
+			return
+		}
+
+		response := GeneralResponse{
+			Type:       "sync",
+			Status:     "Success",
+			StatusCode: 200,
+			Operation:  "",
+			ErrorCode:  0,
+			Error:      "",
+			Metadata:   recordings,
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if recordingsDir == "" || !isLogFileName(operationID) {
+		notFound(w, "Recording not found")
+		return
+	}
+	file, err := os.Open(filepath.Join(recordingsDir, operationID+".cast"))
+	if err != nil {
+		notFound(w, "Recording not found")
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", operationID+".cast"))
+	io.Copy(w, file)
+}
@@ -0,0 +1,85 @@
+package lxcapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// statusError is an error answered with a given HTTP status instead of a 500.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// withStatus attaches the HTTP status a request failing with err is answered with.
+func withStatus(status int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &statusError{status: status, err: err}
+}
+
+// Errors with their status, like fmt.Errorf
+func badRequestError(format string, args ...any) error {
+	return withStatus(http.StatusBadRequest, fmt.Errorf(format, args...))
+}
+
+func notFoundError(format string, args ...any) error {
+	return withStatus(http.StatusNotFound, fmt.Errorf(format, args...))
+}
+
+func conflictError(format string, args ...any) error {
+	return withStatus(http.StatusConflict, fmt.Errorf(format, args...))
+}
+
+// errorStatus returns the HTTP status a request failing with err is answered with.
+func errorStatus(err error) int {
+	var withStatus *statusError
+	if errors.As(err, &withStatus) {
+		return withStatus.status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError writes the LXD error envelope, with status as both the HTTP
+// status and the error code.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(GeneralResponse{
+		Type:      "error",
+		ErrorCode: status,
+		Error:     message,
+	})
+}
+
+// smartError writes err with the status it carries, or as a 500.
+func smartError(w http.ResponseWriter, err error) {
+	writeError(w, errorStatus(err), err.Error())
+}
+
+func badRequest(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, err.Error())
+}
+
+func forbidden(w http.ResponseWriter) {
+	writeError(w, http.StatusForbidden, "not authorized")
+}
+
+func notFound(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusNotFound, message)
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
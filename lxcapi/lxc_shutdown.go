@@ -0,0 +1,71 @@
+package lxcapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Shutdown is run once the HTTP server stopped taking requests. Background
+// tasks get until ctx is done to finish, so lxc-start, lxc-stop or
+// lxc-checkpoint aren't killed halfway through. Operations still in progress
+// after that are cancelled, which kills their commands, and every exec/console
+// session is closed, so the clients see a normal close instead of a dropped
+// connection.
+func Shutdown(ctx context.Context) {
+	for _, metadata := range ListOperationsMetadata() {
+		if metadata.Class != "task" || OperationStatus(metadata.StatusCode).isFinal() {
+			continue
+		}
+		timeout := time.Duration(-1)
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = max(time.Until(deadline), 0)
+		}
+		WaitOperation(metadata.ID, timeout)
+	}
+
+	// Clients are told before their sessions are cancelled and closed
+	closeMessage := websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shutting down")
+	deadline := time.Now().Add(time.Second)
+	for _, session := range ListSessions() {
+		for _, conn := range session.Conns {
+			conn.WriteControl(websocket.CloseMessage, closeMessage, deadline)
+		}
+	}
+
+	for _, metadata := range ListOperationsMetadata() {
+		switch OperationStatus(metadata.StatusCode) {
+		case OperationPending, OperationRunning:
+			if err := cancelOperation(metadata.ID, "Server is shutting down"); err != nil {
+				UpdateOperation(metadata.ID, OperationCancelled, "Server is shutting down")
+			}
+		}
+	}
+	for _, session := range ListSessions() {
+		if session.Cmd != nil && session.Cmd.Process != nil {
+			session.Cmd.Process.Kill()
+		}
+		if session.Ptmx != nil && !session.SharedPtmx {
+			session.Ptmx.Close()
+		}
+		for _, conn := range session.Conns {
+			conn.Close()
+		}
+	}
+
+	// Killed commands are waited for, so none outlives the server
+	tasksDone := make(chan struct{})
+	go func() {
+		runningTasks.Wait()
+		close(tasksDone)
+	}()
+	select {
+	case <-tasksDone:
+	case <-time.After(5 * time.Second):
+	}
+
+	closeConsoles()
+	events.closeAll("Server is shutting down")
+	FlushOperationStore()
+}
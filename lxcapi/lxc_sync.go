@@ -4,14 +4,41 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 )
 
+// Addresses the server is reachable on, reported in environment.addresses
+var serverAddresses []string
+
+// SetServerAddresses sets the addresses the listeners are bound to.
+func SetServerAddresses(addresses []string) {
+	serverAddresses = addresses
+}
+
+// The listen address reported as core.https_address
+var httpsAddress string
+
+// SetHTTPSAddress sets the configured listen address reported as core.https_address.
+func SetHTTPSAddress(address string) {
+	httpsAddress = address
+}
+
 // SyncHandler handles the synchronization request. It processes the HTTP request
 // and sends the appropriate response back to the client.
 func SyncHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Println("Request Method:", r.Method, "|", "Request API:", r.URL.Path)
+
+	// The server configuration comes from config.yaml, attempts to change it
+	// through the API are refused and recorded
+	if r.Method == http.MethodPut || r.Method == http.MethodPatch {
+		if !IsTrusted(r) {
+			forbidden(w)
+			return
+		}
+		err := badRequestError("The server configuration is read-only, it is set in config.yaml")
+		Audit(r, "config-update", "/1.0", err)
+		smartError(w, err)
+		return
+	}
 
 	var authStatus string
 	if IsTrusted(r) {
@@ -22,11 +49,14 @@ func SyncHandler(w http.ResponseWriter, r *http.Request) {
 
 	if authStatus == "trusted" {
 		var clientCN []string
-		if !IsTrustedToken {
-			clientCert := r.TLS.PeerCertificates[0]
+		authMethod := "tls"
+		if clientCert := peerCertificate(r); clientCert != nil {
 			clientCN = clientCert.Subject.Organization
+		} else if ucred, ok := unixPeer(r); ok && isTrustedUnixPeer(r) {
+			clientCN = []string{fmt.Sprint(ucred.Uid)}
+			authMethod = "unix"
 		} else {
-			clientCN = strings.Split(ClientToken, "")
+			clientCN = []string{tokenClientName(requestToken(r))}
 		}
 		response := map[string]any{
 			"type":        "sync",
@@ -37,7 +67,7 @@ func SyncHandler(w http.ResponseWriter, r *http.Request) {
 			"error":       "",
 			"metadata": map[string]any{
 				"config": map[string]any{
-					"core.https_address": "[::]:8443",
+					"core.https_address": httpsAddress,
 				},
 				"api_extensions": []string{
 					"storage_zfs_remove_snapshots",
@@ -449,12 +479,9 @@ func SyncHandler(w http.ResponseWriter, r *http.Request) {
 				"public":           false,
 				"auth_methods":     []string{"tls"},
 				"auth_user_name":   clientCN,
-				"auth_user_method": "tls",
+				"auth_user_method": authMethod,
 				"environment": map[string]any{
-					"addresses": []string{
-						"0.0.0.0:8443",
-						"[::1]:8443",
-					},
+					"addresses":               serverAddresses,
 					"architectures":           []string{"x86_64", "i686", "aarch64"},
 					"certificate":             "-----BEGIN CERTIFICATE-----\nMIIB/DCCAYKgAwIBAgIRAIAQaocMqjtlrX2qQ15ap5AwCgYIKoZIzj0EAwMwLDEM\nMAoGA1UEChMDTFhEMRwwGgYDVQQDDBNyb290QGRyZWFtY29ubmVjdGVkMB4XDTI1\nMDUyODA5MTI1MFoXDTM1MDUyNjA5MTI1MFowLDEMMAoGA1UEChMDTFhEMRwwGgYD\nVQQDDBNyb290QGRyZWFtY29ubmVjdGVkMHYwEAYHKoZIzj0CAQYFK4EEACIDYgAE\nwZrN6JvYy+p93cwBIrkGwQReurIRio9VuGGX4xfcZOwprw9FcR6GrwPpRoFI2a6p\np47+MD04fP/Km3UmXcHLxVqFyZnJO2M13O1+B7jOeg/xCb6TmCwSO1hrlCqYcw79\no2gwZjAOBgNVHQ8BAf8EBAMCBaAwEwYDVR0lBAwwCgYIKwYBBQUHAwEwDAYDVR0T\nAQH/BAIwADAxBgNVHREEKjAogg5kcmVhbWNvbm5lY3RlZIcEfwAAAYcQAAAAAAAA\nAAAAAAAAAAAAATAKBggqhkjOPQQDAwNoADBlAjA5nuIZjrHm4L2/KJD4NmbhBBYk\nq1jkLGyyPmGsI5AjabbEO7whTr9KLB2KTl0iJycCMQConkVsBTpNzJiBfwzZtl9a\nEZGSLe3aCwBEd/cmkCtWeHr2GdOWFB8OKLZJ8jsHRD0=\n-----END CERTIFICATE-----\n",
 					"certificate_fingerprint": "6d1dd9a759eb2782dae4fdf1d7163ebd2a2f07c69d9aa106859a5d39aa60e1f0",
@@ -489,6 +516,7 @@ func SyncHandler(w http.ResponseWriter, r *http.Request) {
 						"seccomp_allow_deny_syntax":    "true",
 						"seccomp_notify":               "true",
 						"seccomp_proxy_send_notify_fd": "true",
+						"criu":                         fmt.Sprint(criuSupported),
 					},
 					"os_name":           "Android",
 					"os_version":        "",
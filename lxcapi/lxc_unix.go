@@ -0,0 +1,59 @@
+package lxcapi
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"syscall"
+)
+
+type unixPeerKey struct{}
+
+// Peers on the unix socket that are trusted without a certificate
+var unixAllowedUids, unixAllowedGids []uint32
+
+// SetUnixSocketAllow sets the uids and gids that may use the unix socket.
+func SetUnixSocketAllow(uids, gids []uint32) {
+	unixAllowedUids = uids
+	unixAllowedGids = gids
+}
+
+// UnixConnContext is used as http.Server.ConnContext. It stores the SO_PEERCRED
+// credentials of unix socket connections in the request context.
+func UnixConnContext(ctx context.Context, c net.Conn) context.Context {
+	unixConn, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+
+	rawConn, err := unixConn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	err = rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, unixPeerKey{}, ucred)
+}
+
+// unixPeer returns the credentials of the peer if the request came in over the unix socket.
+func unixPeer(r *http.Request) (*syscall.Ucred, bool) {
+	ucred, ok := r.Context().Value(unixPeerKey{}).(*syscall.Ucred)
+	return ucred, ok
+}
+
+func isTrustedUnixPeer(r *http.Request) bool {
+	ucred, ok := unixPeer(r)
+	if !ok {
+		return false
+	}
+	return slices.Contains(unixAllowedUids, ucred.Uid) || slices.Contains(unixAllowedGids, ucred.Gid)
+}
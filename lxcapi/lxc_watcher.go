@@ -0,0 +1,203 @@
+package lxcapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// instanceWatcher remembers the last known state of every container so state
+// changes made outside of the API (lxc-stop on the host...) can be published.
+type instanceWatcher struct {
+	mu     sync.Mutex
+	known  bool
+	states map[string]string
+	// Instances changed through the API right now, the API sends their events
+	busy map[string]int
+	// Instances whose state must be re-read without an event
+	resync map[string]bool
+	// Counts the begins and ends of API changes. A poll that started before
+	// the last begin or end of an instance may have read a stale state of it.
+	generation uint64
+	changedAt  map[string]uint64
+}
+
+var watcher = &instanceWatcher{
+	states:    make(map[string]string),
+	busy:      make(map[string]int),
+	resync:    make(map[string]bool),
+	changedAt: make(map[string]uint64),
+}
+
+// WatchInstances polls lxc-ls every interval until ctx is done.
+func WatchInstances(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		watcher.poll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// beginInstanceChange stops the watcher from reporting changes of the instance
+// while the API is changing it.
+func beginInstanceChange(instanceName string) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	watcher.busy[instanceName]++
+	watcher.generation++
+	watcher.changedAt[instanceName] = watcher.generation
+}
+
+// endInstanceChange drops the cached state of the instance, the next poll
+// picks up the new state quietly.
+func endInstanceChange(instanceName string) {
+	watcher.mu.Lock()
+	defer watcher.mu.Unlock()
+
+	watcher.busy[instanceName]--
+	if watcher.busy[instanceName] <= 0 {
+		delete(watcher.busy, instanceName)
+	}
+	watcher.resync[instanceName] = true
+	watcher.generation++
+	watcher.changedAt[instanceName] = watcher.generation
+}
+
+// skip tells whether the state of an instance read by a poll that started at
+// generation must be ignored, because the API is changing the instance or
+// changed it while the poll ran. iw.mu must be held.
+func (iw *instanceWatcher) skip(name string, generation uint64) bool {
+	return iw.busy[name] > 0 || iw.changedAt[name] > generation
+}
+
+func (iw *instanceWatcher) poll() {
+	iw.mu.Lock()
+	generation := iw.generation
+	iw.mu.Unlock()
+
+	states, err := listInstanceStates()
+	if err != nil {
+		slog.Debug("Unable to list instances", "err", err)
+		return
+	}
+
+	type change struct {
+		action string
+		name   string
+	}
+	var changes []change
+
+	iw.mu.Lock()
+	for name, state := range states {
+		if iw.skip(name, generation) {
+			continue
+		}
+		previous, exists := iw.states[name]
+		iw.states[name] = state
+		if !iw.known || iw.resync[name] {
+			delete(iw.resync, name)
+			delete(iw.changedAt, name)
+			continue
+		}
+		if !exists {
+			changes = append(changes, change{lifecycleInstanceCreated, name})
+			continue
+		}
+		if action := stateTransitionLifecycle(previous, state); action != "" {
+			changes = append(changes, change{action, name})
+		}
+	}
+	for name := range iw.states {
+		if _, exists := states[name]; exists || iw.skip(name, generation) {
+			continue
+		}
+		delete(iw.states, name)
+		delete(iw.resync, name)
+		delete(iw.changedAt, name)
+		if iw.known {
+			changes = append(changes, change{lifecycleInstanceDeleted, name})
+		}
+	}
+	iw.known = true
+	iw.mu.Unlock()
+
+	for _, change := range changes {
+		slog.Info("Instance changed outside of the API", "instance", change.name, "action", change.action)
+		SendLifecycleEvent(change.action, "/1.0/instances/"+change.name, nil, nil)
+	}
+}
+
+// stateTransitionLifecycle returns the lifecycle action of a state change as
+// reported by lxc-ls, or "" for states in between like STOPPING.
+func stateTransitionLifecycle(previous, state string) string {
+	if previous == state {
+		return ""
+	}
+	switch state {
+	case "RUNNING":
+		if previous == "FROZEN" {
+			return lifecycleInstanceResumed
+		}
+		return lifecycleInstanceStarted
+	case "STOPPED":
+		return lifecycleInstanceStopped
+	case "FROZEN":
+		return lifecycleInstancePaused
+	}
+	return ""
+}
+
+// instanceState returns the lxc state of an instance, like RUNNING or FROZEN,
+// or an empty string if it doesn't exist.
+func instanceState(instanceName string) string {
+	states, err := listInstanceStates()
+	if err != nil {
+		return ""
+	}
+	return states[instanceName]
+}
+
+// checkInstanceExists fails with a 404 error if there is no instance by that name.
+func checkInstanceExists(instanceName string) error {
+	states, err := listInstanceStates()
+	if err != nil {
+		return fmt.Errorf("Unable to list instances: %v", err)
+	}
+	if _, exists := states[instanceName]; !exists {
+		return notFoundError("Instance not found")
+	}
+	return nil
+}
+
+// listInstanceStates returns the lxc-ls state of every container by name.
+func listInstanceStates() (map[string]string, error) {
+	cmd := exec.Command("lxc-ls", "-f", "-F", "NAME,STATE")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	states := make(map[string]string)
+	lines := strings.Split(out.String(), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		states[fields[0]] = fields[1]
+	}
+	return states, nil
+}
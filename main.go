@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	tools "github/dreamconnected/lxc-ui-api/internal"
 	"github/dreamconnected/lxc-ui-api/lxcapi"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -24,6 +31,12 @@ type Token struct {
 	Token string `yaml:"token"`
 }
 
+type Listen struct {
+	Address       string `yaml:"address"`
+	ServerCert    string `yaml:"server-cert"`
+	ServerCertKey string `yaml:"server-cert-key"`
+}
+
 type Config struct {
 	Server struct {
 		IP            string `yaml:"ip"`
@@ -31,11 +44,53 @@ type Config struct {
 		Cert          string `yaml:"cert"`
 		ServerCert    string `yaml:"server-cert"`
 		ServerCertKey string `yaml:"server-cert-key"`
+		// Several addresses with their own certificates, replaces ip and port
+		Listen []Listen `yaml:"listen"`
+		// Plain HTTP address that only redirects to HTTPS
+		HTTPRedirect string `yaml:"http-redirect"`
+		// How long in-flight requests may take to finish on SIGTERM/SIGINT
+		ShutdownTimeout time.Duration `yaml:"shutdown-timeout"`
+		// Local administration without a certificate
+		UnixSocket      string `yaml:"unix-socket"`
+		UnixSocketAllow struct {
+			Uids []uint32 `yaml:"uids"`
+			Gids []uint32 `yaml:"gids"`
+		} `yaml:"unix-socket-allow"`
 	} `yaml:"server"`
 	Client struct {
 		Certs  []Cert  `yaml:"certs"`
 		Tokens []Token `yaml:"tokens"`
 	} `yaml:"client"`
+	Log struct {
+		Level     string `yaml:"level"`
+		Format    string `yaml:"format"`
+		AccessLog string `yaml:"access-log"`
+	} `yaml:"log"`
+	Lxc struct {
+		// How often to look for changes made outside of the API
+		WatchInterval time.Duration `yaml:"watch-interval"`
+		// Holds a log directory per instance
+		LogsDir string `yaml:"logs-dir"`
+		// Saved states of stateful stops
+		CheckpointsDir string `yaml:"checkpoints-dir"`
+		// How long a console nobody is attached to is kept running
+		ConsoleIdleTimeout time.Duration `yaml:"console-idle-timeout"`
+	} `yaml:"lxc"`
+	Operations struct {
+		// How long finished operations are kept
+		Retention time.Duration `yaml:"retention"`
+		// How long exec and console websockets may take to connect
+		WebsocketTimeout time.Duration `yaml:"websocket-timeout"`
+		// Optional file to keep the operations across restarts
+		Store string `yaml:"store"`
+	} `yaml:"operations"`
+	Audit struct {
+		Path       string `yaml:"path"`
+		MaxSize    int64  `yaml:"max-size"`
+		MaxBackups int    `yaml:"max-backups"`
+		// Directory for asciinema recordings of exec and console sessions
+		Recordings string `yaml:"recordings"`
+	} `yaml:"audit"`
 }
 
 func main() {
@@ -52,8 +107,54 @@ func main() {
 	}
 	configFile.Close()
 
-	address := fmt.Sprintf("%s:%d", config.Server.IP, config.Server.Port)
-	fmt.Printf("Start LXC-API service: %s\n", address)
+	logger, err := tools.NewLogger(os.Stderr, config.Log.Level, config.Log.Format)
+	if err != nil {
+		log.Fatalf("Bad log config: %v\n", err)
+	}
+	slog.SetDefault(slog.New(lxcapi.NewEventLogHandler(logger.Handler())))
+
+	accessLogger := slog.Default()
+	if config.Log.AccessLog != "" {
+		accessLogFile, err := tools.OpenLogFile(config.Log.AccessLog)
+		if err != nil {
+			log.Fatalf("Bad log config: %v\n", err)
+		}
+		accessLogger, _ = tools.NewLogger(accessLogFile, config.Log.Level, config.Log.Format)
+	}
+
+	if config.Audit.Path != "" {
+		maxBackups := config.Audit.MaxBackups
+		if maxBackups == 0 {
+			maxBackups = 5
+		}
+		// max-size is given in MiB
+		if err := lxcapi.SetupAudit(config.Audit.Path, config.Audit.MaxSize<<20, maxBackups); err != nil {
+			log.Fatalf("Bad audit config: %v\n", err)
+		}
+	}
+
+	if config.Audit.Recordings != "" {
+		if err := lxcapi.SetupRecordings(config.Audit.Recordings); err != nil {
+			log.Fatalf("Bad audit config: %v\n", err)
+		}
+	}
+
+	if config.Lxc.LogsDir != "" {
+		lxcapi.SetLogsDir(config.Lxc.LogsDir)
+	}
+	if config.Lxc.CheckpointsDir != "" {
+		lxcapi.SetCheckpointsDir(config.Lxc.CheckpointsDir)
+	}
+	lxcapi.DetectCRIU()
+	if config.Lxc.ConsoleIdleTimeout > 0 {
+		lxcapi.SetConsoleIdleTimeout(config.Lxc.ConsoleIdleTimeout)
+	}
+
+	if config.Operations.Store != "" {
+		if err := lxcapi.SetupOperationStore(config.Operations.Store); err != nil {
+			log.Fatalf("Bad operations config: %v\n", err)
+		}
+	}
 
 	if config.Server.ServerCert == "" && config.Server.ServerCertKey == "" {
 		cert, _ = tools.GenerateSelfSignedCert()
@@ -79,7 +180,7 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/1.0/events", lxcapi.HandleOperationsWebSocket)
-	mux.HandleFunc("/1.0/operations/", lxcapi.HandleOperationsWebSocketTerminal)
+	mux.HandleFunc("/1.0/operations/", lxcapi.OperationHandler)
 	lxc_ui_path, exists := os.LookupEnv("LXC_UI")
 	if exists {
 		mux.HandleFunc("/ui/", tools.SpaHandler(lxc_ui_path))
@@ -100,14 +201,154 @@ func main() {
 	mux.HandleFunc("/1.0/certificates", lxcapi.CertificatesHandler)
 	mux.HandleFunc("/1.0/networks", lxcapi.NetworksHandler)
 	mux.HandleFunc("/1.0/networks/", lxcapi.NetworksHandler)
+	mux.HandleFunc("/1.0/admin/audit", lxcapi.AuditHandler)
+	mux.HandleFunc("/1.0/admin/recordings", lxcapi.RecordingsHandler)
+	mux.HandleFunc("/1.0/admin/recordings/", lxcapi.RecordingsHandler)
+
+	// Use the sockets from systemd if we were socket activated
+	activated, err := tools.SystemdListeners()
+	if err != nil {
+		log.Fatalf("Socket activation failed: %v\n", err)
+	}
+	var listeners []net.Listener
+	listenerTLS := make(map[net.Listener]*tls.Config)
+	for _, listener := range activated {
+		listeners = append(listeners, listener)
+		listenerTLS[listener] = tlsConfig
+	}
+	if len(activated) > 0 {
+		lxcapi.SetHTTPSAddress(activated[0].Addr().String())
+	}
+
+	if len(activated) == 0 {
+		listens := config.Server.Listen
+		if len(listens) == 0 {
+			listens = []Listen{{Address: net.JoinHostPort(config.Server.IP, fmt.Sprint(config.Server.Port))}}
+		}
+		// Like LXD, core.https_address is the address as configured, like [::]:8443
+		lxcapi.SetHTTPSAddress(listens[0].Address)
+		for _, listen := range listens {
+			listenConfig := tlsConfig
+			if listen.ServerCert != "" || listen.ServerCertKey != "" {
+				listenCert, err := tools.LoadCert(listen.ServerCert, listen.ServerCertKey)
+				if err != nil {
+					log.Fatalf("Unable to load certificate for %s: %v\n", listen.Address, err)
+				}
+				listenConfig = tlsConfig.Clone()
+				listenConfig.Certificates = []tls.Certificate{listenCert}
+			}
+
+			listener, err := net.Listen("tcp", listen.Address)
+			if err != nil {
+				log.Fatalf("Service startup failed: %v\n", err)
+			}
+			listeners = append(listeners, listener)
+			listenerTLS[listener] = listenConfig
+		}
+	}
+
+	var addresses []string
+	var httpsPort string
+	for _, listener := range listeners {
+		slog.Info("Start LXC-API service", "address", listener.Addr().String())
+		addresses = append(addresses, tools.ListenAddresses(listener.Addr())...)
+		if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok && httpsPort == "" {
+			httpsPort = fmt.Sprint(tcpAddr.Port)
+		}
+	}
+	lxcapi.SetServerAddresses(addresses)
+
+	if config.Server.UnixSocket != "" {
+		listener, err := tools.ListenUnix(config.Server.UnixSocket, 0660)
+		if err != nil {
+			log.Fatalf("Service startup failed: %v\n", err)
+		}
+		defer os.Remove(config.Server.UnixSocket)
+		listeners = append(listeners, listener)
+		slog.Info("Start LXC-API service", "address", config.Server.UnixSocket)
+	}
+
+	// Only root is trusted on the unix socket unless told otherwise
+	allowUids, allowGids := config.Server.UnixSocketAllow.Uids, config.Server.UnixSocketAllow.Gids
+	if len(allowUids) == 0 && len(allowGids) == 0 {
+		allowUids = []uint32{0}
+	}
+	lxcapi.SetUnixSocketAllow(allowUids, allowGids)
 
 	server := &http.Server{
-		Addr:      address,
-		Handler:   mux,
-		TLSConfig: tlsConfig,
+		Handler:     lxcapi.LogMiddleware(accessLogger, mux),
+		TLSConfig:   tlsConfig,
+		ConnContext: lxcapi.UnixConnContext,
 	}
 
-	if err := server.ListenAndServeTLS("", ""); err != nil {
-		log.Fatalf("Service startup failed: %v\n", err)
+	serveErrors := make(chan error, len(listeners)+1)
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			// Unix socket peers are identified by SO_PEERCRED, not TLS
+			if _, ok := listener.(*net.UnixListener); ok {
+				serveErrors <- server.Serve(listener)
+				return
+			}
+			serveErrors <- server.Serve(tls.NewListener(listener, listenerTLS[listener]))
+		}(listener)
 	}
+
+	var redirectServer *http.Server
+	if config.Server.HTTPRedirect != "" && httpsPort != "" {
+		redirectServer = &http.Server{
+			Addr:    config.Server.HTTPRedirect,
+			Handler: tools.RedirectHandler(httpsPort),
+		}
+		slog.Info("Start HTTP redirect", "address", config.Server.HTTPRedirect)
+		go func() {
+			serveErrors <- redirectServer.ListenAndServe()
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	watchInterval := config.Lxc.WatchInterval
+	if watchInterval <= 0 {
+		watchInterval = 5 * time.Second
+	}
+	go lxcapi.WatchInstances(ctx, watchInterval)
+
+	retention := config.Operations.Retention
+	if retention <= 0 {
+		retention = 24 * time.Hour
+	}
+	websocketTimeout := config.Operations.WebsocketTimeout
+	if websocketTimeout <= 0 {
+		websocketTimeout = time.Minute
+	}
+	go lxcapi.CollectOperations(ctx, retention, websocketTimeout)
+
+	select {
+	case err := <-serveErrors:
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Service startup failed: %v\n", err)
+		}
+	case <-ctx.Done():
+	}
+
+	shutdownTimeout := config.Server.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = 30 * time.Second
+	}
+	slog.Info("Stop LXC-API service", "timeout", shutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if redirectServer != nil {
+		redirectServer.Shutdown(shutdownCtx)
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Graceful shutdown failed", "err", err)
+		server.Close()
+	}
+
+	// Websockets are hijacked and not waited for by server.Shutdown, background
+	// tasks get what is left of the timeout
+	lxcapi.Shutdown(shutdownCtx)
 }